@@ -0,0 +1,118 @@
+package main
+
+import (
+	l "log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxAcceptDelay is the maximum delay before accepting connections again
+// after a temporary accept error.
+const maxAcceptDelay = time.Second
+
+// maxRefusing is the maximum number of refused connections receiving the
+// reason of the refusal at the same time. Connections refused above it are
+// closed immediately.
+const maxRefusing = 100
+
+// errTooManyConns is the reason of the refusal of a connection above the
+// connection limit of a listener.
+var errTooManyConns = errors.New("too many connections")
+
+// acceptor accepts the connections of a listener and serves them.
+type acceptor struct {
+	listener net.Listener
+	conns    *connSet
+	maxConns int64  // maximum number of open connections, no limit if 0
+	open     int64  // number of open connections
+	refused  uint64 // number of refused connections
+	refusing chan struct{}
+	stats    *Stats
+	log      *l.Logger
+	serve    func(conn net.Conn) // serves an accepted connection
+	refuse   func(conn net.Conn) // refuses a connection, nil to close it
+}
+
+// newAcceptor returns an acceptor serving the connections of listener with
+// serve, and refusing the connections above maxConns with refuse.
+func newAcceptor(listener net.Listener, conns *connSet, maxConns int, stats *Stats, log *l.Logger, serve, refuse func(conn net.Conn)) *acceptor {
+	return &acceptor{
+		listener: listener,
+		conns:    conns,
+		maxConns: int64(maxConns),
+		refusing: make(chan struct{}, maxRefusing),
+		stats:    stats,
+		log:      log,
+		serve:    serve,
+		refuse:   refuse,
+	}
+}
+
+// run accepts connections until the connection set is stopped. Temporary
+// errors, such as file descriptor exhaustion, are retried with an exponential
+// backoff.
+func (a *acceptor) run() {
+	var delay time.Duration
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if a.conns.stopped() {
+				return
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				a.log.Fatalln("accept error:", err)
+			}
+			a.stats.AcceptFailed()
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			a.log.Printf("accept error: %v, retry in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if a.maxConns > 0 && atomic.LoadInt64(&a.open) >= a.maxConns {
+			if a.refused%1000 == 0 {
+				a.log.Printf("refuse connection from %s: %v (%d refused)", conn.RemoteAddr(), errTooManyConns, a.refused+1)
+			}
+			a.refused++
+			a.stats.ConnRefused()
+			a.refuseConn(conn)
+			continue
+		}
+		a.stats.ConnAccepted()
+		atomic.AddInt64(&a.open, 1)
+		a.conns.add(conn)
+		go func(conn net.Conn) {
+			defer func() {
+				a.conns.remove(conn)
+				atomic.AddInt64(&a.open, -1)
+				a.stats.ConnClosed()
+			}()
+			a.serve(conn)
+		}(conn)
+	}
+}
+
+// refuseConn refuses the connection conn above the connection limit.
+func (a *acceptor) refuseConn(conn net.Conn) {
+	if a.refuse == nil {
+		conn.Close()
+		return
+	}
+	select {
+	case a.refusing <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-a.refusing }()
+		a.refuse(conn)
+	}()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// msgItem is a message transmitted from a receiver to the outputs.
+type msgItem struct {
+	data []byte
+	ack  *msgAck // nil when the sender expects no end-to-end acknowledgment
+}
+
+// acker receives the acknowledgments of the messages it sent to the outputs.
+type acker interface {
+	// ack sets the acknowledgment code of the message seq.
+	ack(seq uint64, code byte)
+	// fail reports that a message was lost by an output.
+	fail()
+}
+
+// msgAck is the end-to-end acknowledgment state of a received message. The
+// message is acknowledged to the sender when all outputs accepted it.
+type msgAck struct {
+	refs int32 // number of outputs that didn't accept the message yet
+	win  acker
+	seq  uint64
+}
+
+// setOutputs sets the number of outputs that must accept the message.
+func (a *msgAck) setOutputs(n int) {
+	atomic.StoreInt32(&a.refs, int32(n))
+}
+
+// done reports that an output accepted the message (ok is true) or lost it.
+func (a *msgAck) done(ok bool) {
+	if !ok {
+		a.win.fail()
+		return
+	}
+	if atomic.AddInt32(&a.refs, -1) == 0 {
+		a.win.ack(a.seq, ackCode)
+	}
+}
+
+// ackWindow sends the acknowledgments of the messages received on a
+// connection in their reception order, once accepted by the outputs.
+type ackWindow struct {
+	mtx    sync.Mutex
+	conn   net.Conn
+	acks   chan byte
+	next   uint64 // sequence number of the next message
+	first  uint64 // sequence number of the first unacknowledged message
+	codes  []byte // acknowledgment codes of the unacknowledged messages, 0 if pending
+	failed bool
+	closed bool
+}
+
+// newAckWindow returns a new ackWindow sending acknowledgments in acks.
+func newAckWindow(conn net.Conn, acks chan byte) *ackWindow {
+	return &ackWindow{conn: conn, acks: acks}
+}
+
+// add returns the acknowledgment state of a new received message.
+func (w *ackWindow) add() *msgAck {
+	w.mtx.Lock()
+	a := &msgAck{refs: 1, win: w, seq: w.next}
+	w.next++
+	w.codes = append(w.codes, 0)
+	w.mtx.Unlock()
+	return a
+}
+
+// nak adds a received message rejected by the receiver.
+func (w *ackWindow) nak() {
+	w.ack(w.add().seq, nakCode)
+}
+
+// ack sets the acknowledgment code of the message seq, and sends the
+// acknowledgments of the messages in front of the window that are done. It
+// is called by the outputs and never blocks: when the acks channel is full,
+// because the client doesn't read its acknowledgments or the writer is gone,
+// the window fails.
+func (w *ackWindow) ack(seq uint64, code byte) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed || w.failed {
+		return
+	}
+	w.codes[seq-w.first] = code
+	n := 0
+	for n < len(w.codes) && w.codes[n] != 0 {
+		select {
+		case w.acks <- w.codes[n]:
+		default:
+			w.failLocked()
+			return
+		}
+		n++
+	}
+	w.first += uint64(n)
+	w.codes = w.codes[:copy(w.codes, w.codes[n:])]
+}
+
+// fail closes the connection when a message is lost by an output. The sender
+// will send again the unacknowledged messages when it reconnects.
+func (w *ackWindow) fail() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.failed || w.closed {
+		return
+	}
+	w.failLocked()
+}
+
+// failLocked closes the connection. w.mtx must be held.
+func (w *ackWindow) failLocked() {
+	w.failed = true
+	w.conn.Close()
+}
+
+// wait waits until all messages are acknowledged, the window failed, or the
+// timeout expired.
+func (w *ackWindow) wait(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		w.mtx.Lock()
+		done := w.failed || len(w.codes) == 0
+		w.mtx.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(flushPeriod)
+	}
+}
+
+// close closes the acks channel. Later acknowledgments are ignored.
+func (w *ackWindow) close() {
+	w.mtx.Lock()
+	w.closed = true
+	close(w.acks)
+	w.mtx.Unlock()
+}
+
+// ackQueue holds the acknowledgment states of the messages written to an
+// output, in write order, until the output accepts them.
+type ackQueue struct {
+	mtx  sync.Mutex
+	acks []*msgAck
+}
+
+// push appends the acknowledgment states of written messages.
+func (q *ackQueue) push(acks ...*msgAck) {
+	q.mtx.Lock()
+	q.acks = append(q.acks, acks...)
+	q.mtx.Unlock()
+}
+
+// len returns the number of messages waiting to be accepted.
+func (q *ackQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.acks)
+}
+
+// accepted reports that the n first messages have been accepted (ok is true)
+// or lost by the output.
+func (q *ackQueue) accepted(n int, ok bool) {
+	q.mtx.Lock()
+	if n > len(q.acks) {
+		n = len(q.acks)
+	}
+	acks := make([]*msgAck, n)
+	copy(acks, q.acks)
+	q.acks = q.acks[:copy(q.acks, q.acks[n:])]
+	q.mtx.Unlock()
+	for _, a := range acks {
+		if a != nil {
+			a.done(ok)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"crypto/x509"
-	"fmt"
 	"log"
 	"time"
 
@@ -13,6 +12,11 @@ func runAsClient(addresses []string, keyFile, crtFile string, certPool *x509.Cer
 	log.SetPrefix("client  ")
 	log.Println("target:", *addressFlag)
 
+	if *tailFlag != "" {
+		runAsShipper(*tailFlag, addresses, keyFile, crtFile, certPool, stats)
+		return
+	}
+
 	m := Msg{
 		Stamp:     time.Now().UTC().Format("2006-01-02 15:04:05"),
 		Level:     "INFO",
@@ -21,19 +25,46 @@ func runAsClient(addresses []string, keyFile, crtFile string, certPool *x509.Cer
 		Message:   "no problem",
 	}
 
-	msgs := make(chan []byte, 1000)
+	// messages are generated with the preferred encoding
+	binaryEnc := splitAddresses(*encodingFlag)[0] == "B"
+
+	q := newOutputQueue("fwd", 1000)
+	msgs := q.msgs
 
-	go fwdOutput(msgs, addresses, keyFile, crtFile, certPool)
+	done := make(chan struct{})
+	go func() {
+		runOutput(newFwdState(addresses, keyFile, crtFile, certPool), q, maxMsgs, stats)
+		close(done)
+	}()
 
+	shutdown := shutdownSignal()
 	for {
 		m.Stamp = time.Now().UTC().Format("2006-01-02 15:04:05")
-		msg := []byte(fmt.Sprintf(`J{"asctime":"%s","levelname":"%s","name":"%s","componentname":"%s","message":"%s"}`,
-			m.Stamp, m.Level, m.System, m.Component, m.Message))
-		// msg, err := json.Marshal(m)
-		// if err != nil {
-		// 	log.Fatalln("json encode:", err)
-		// }
-		msgs <- msg
-		stats.Update(len(msg))
+		var (
+			msg []byte
+			err error
+		)
+		if binaryEnc {
+			msg, err = m.BinaryEncode(make([]byte, 0, 64+len(m.Message)))
+		} else {
+			msg, err = m.JSONEncode()
+		}
+		if err != nil {
+			log.Fatalln("encode:", err)
+		}
+		select {
+		case msgs <- msgItem{data: msg}:
+			stats.Update(len(msg))
+		case <-shutdown:
+			// wait until the queued messages are acknowledged
+			close(msgs)
+			select {
+			case <-done:
+				log.Println("shutdown: done")
+			case <-time.After(time.Duration(*shutdownFlag) * time.Second):
+				log.Println("shutdown: drain deadline exceeded, pending messages may be lost")
+			}
+			return
+		}
 	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// compressions are the supported compressions of the DLCM message stream.
+var compressions = []string{"flate", "gzip"}
+
+// flushWriter is a compressing writer of the DLCM message stream.
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressor returns a writer compressing into w with the given compression.
+func newCompressor(compression string, w io.Writer) (flushWriter, error) {
+	switch compression {
+	case "flate":
+		return flate.NewWriter(w, flate.BestSpeed)
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	return nil, errors.Errorf("unknown compression '%s'", compression)
+}
+
+// newDecompressor returns a reader decompressing r with the given compression.
+func newDecompressor(compression string, r io.Reader) (io.Reader, error) {
+	switch compression {
+	case "flate":
+		return flate.NewReader(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	}
+	return nil, errors.Errorf("unknown compression '%s'", compression)
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	l "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// deadLetter appends the messages that can't be delivered to a file, as
+// DLCM frames. The file is created when the first message is written.
+type deadLetter struct {
+	mtx   sync.Mutex
+	path  string
+	file  *os.File
+	count uint64 // number of messages written
+}
+
+// newDeadLetter returns a deadLetter writing in the file at path.
+func newDeadLetter(path string) *deadLetter {
+	return &deadLetter{path: path}
+}
+
+// defaultDeadLetterPath returns the default dead letter file of the outputs
+// with the URL scheme: the file of the deadletter flag, with the scheme
+// appended to its name (e.g. deadletter-mysql.dlcm).
+func defaultDeadLetterPath(scheme string) string {
+	ext := filepath.Ext(*deadLetterFlag)
+	return strings.TrimSuffix(*deadLetterFlag, ext) + "-" + scheme + ext
+}
+
+// write appends msg to the dead letter file.
+func (d *deadLetter) write(msg []byte) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.file == nil {
+		var err error
+		d.file, err = os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+		if err != nil {
+			return errors.Wrap(err, "open dead letter file")
+		}
+	}
+	frame := make([]byte, 8+len(msg))
+	copy(frame, "DLCM")
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(msg)))
+	copy(frame[8:], msg)
+	if _, err := d.file.Write(frame); err != nil {
+		return errors.Wrap(err, "write dead letter file")
+	}
+	d.count++
+	return nil
+}
+
+// rejecter moves the messages an output can't deliver to a dead letter file,
+// and counts the messages retried, dropped and dead-lettered by the output.
+type rejecter struct {
+	deadLetter *deadLetter
+	log        *l.Logger
+	unit       string // name of a message in the logs (e.g. row)
+	retried    uint64 // number of messages sent again after a failure
+	dropped    uint64 // number of messages lost
+	rejected   uint64 // number of messages moved to the dead letter file
+}
+
+// newRejecter returns a rejecter moving the messages to the dead letter file
+// at path, and logging with log.
+func newRejecter(path string, log *l.Logger, unit string) rejecter {
+	return rejecter{deadLetter: newDeadLetter(path), log: log, unit: unit}
+}
+
+// reject moves the message msg that can't be delivered to the dead letter
+// file. The message is dropped if this fails.
+func (r *rejecter) reject(msg []byte, cause error) {
+	if r.rejected%1000 == 0 {
+		r.log.Printf("reject %s: %v", r.unit, cause)
+	}
+	if err := r.deadLetter.write(msg); err != nil {
+		r.log.Printf("drop %s: %v", r.unit, err)
+		r.dropped++
+		return
+	}
+	r.rejected++
+}
+
+// counts returns the numbers of messages retried, dropped and dead-lettered.
+func (r *rejecter) counts() [3]uint64 {
+	return [3]uint64{r.retried, r.dropped, r.rejected}
+}
+
+// logCounts logs the counts if they changed since before.
+func (r *rejecter) logCounts(before [3]uint64) {
+	if r.counts() != before {
+		r.log.Printf("%ss retried: %d, dropped: %d, dead-lettered: %d", r.unit, r.retried, r.dropped, r.rejected)
+	}
+}
+
+// close syncs and closes the dead letter file.
+func (d *deadLetter) close() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	if err := d.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync dead letter file")
+	}
+	err := d.file.Close()
+	d.file = nil
+	return errors.Wrap(err, "close dead letter file")
+}
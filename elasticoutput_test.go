@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestElasticOutput returns an elasticOutput sending to a test server
+// answering the bulk requests with handler.
+func newTestElasticOutput(t *testing.T, retries string, handler http.HandlerFunc) (*elasticOutput, *[2]int) {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse("elasticsearch://" + srv.Listener.Addr().String() + "/?retries=" + retries +
+		"&deadletter=" + url.QueryEscape(filepath.Join(t.TempDir(), "deadletter.dlcm")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := newElasticOutput(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := out.(*elasticOutput)
+	var accepted [2]int // messages accepted and lost
+	o.SetAccepted(func(n int, ok bool) {
+		if ok {
+			accepted[0] += n
+		} else {
+			accepted[1] += n
+		}
+	})
+	return o, &accepted
+}
+
+func TestElasticOutputClientError(t *testing.T) {
+	var requests int32
+	o, accepted := newTestElasticOutput(t, "0", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+	})
+	o.Write([][]byte{testMessage(t, "first", false), testMessage(t, "second", false)})
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected 1 bulk request, got %d", n)
+	}
+	if o.rejected != 2 || o.dropped != 0 {
+		t.Errorf("expected 2 documents dead-lettered and none dropped, got %d and %d", o.rejected, o.dropped)
+	}
+	if *accepted != [2]int{2, 0} {
+		t.Errorf("expected 2 messages accepted, got %v", *accepted)
+	}
+}
+
+func TestElasticOutputUnavailable(t *testing.T) {
+	var requests int32
+	o, accepted := newTestElasticOutput(t, "0", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`))
+	})
+	o.Write([][]byte{testMessage(t, "first", false)})
+	o.Flush()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 bulk requests, got %d", n)
+	}
+	if o.rejected != 0 || o.retried != 1 {
+		t.Errorf("expected 1 document retried and none dead-lettered, got %d and %d", o.retried, o.rejected)
+	}
+	if *accepted != [2]int{1, 0} {
+		t.Errorf("expected 1 message accepted, got %v", *accepted)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// enrichFieldNames are the fields that can be added to the received messages:
+//
+//	host:      resolved host name of the client
+//	ip:        IP address of the client
+//	cn:        common name of the client TLS certificate
+//	client:    name given by the client in the open connection handshake
+//	rtime:     reception time of the message (RFC3339 in UTC)
+//	collector: host name of this logCollector
+var enrichFieldNames = []string{"host", "ip", "cn", "client", "rtime", "collector"}
+
+// enrichFields are the fields added to the received messages, set from the
+// enrich flag.
+var enrichFields []string
+
+// parseEnrichFields returns the enrichment fields in the comma separated list.
+func parseEnrichFields(list string) ([]string, error) {
+	fields := splitAddresses(list)
+	for _, f := range fields {
+		if chooseOption([]string{f}, enrichFieldNames) == "" {
+			return nil, errors.Errorf("unknown enrichment field '%s', expected one of %v", f, enrichFieldNames)
+		}
+	}
+	return fields, nil
+}
+
+// field is a named message field.
+type field struct {
+	key   string
+	value string
+}
+
+// enricher adds fields to the messages received on a connection. Fields
+// already present in a message are left unchanged.
+type enricher struct {
+	fields []field // fields with a value constant over the connection
+	rtime  bool    // add the reception time
+}
+
+// newEnricher returns an enricher adding the fields names to the messages
+// received on conn from the client name. The fields of the connection (host,
+// ip and cn) are not added when conn is nil.
+func newEnricher(conn net.Conn, name string, names []string) *enricher {
+	e := &enricher{}
+	for _, n := range names {
+		if conn == nil && (n == "host" || n == "ip" || n == "cn") {
+			continue
+		}
+		var v string
+		switch n {
+		case "host":
+			v = "???"
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				if names, _ := net.LookupAddr(addr.IP.String()); len(names) > 0 {
+					// remove trailing . if any
+					v = names[0]
+					if len(v) > 0 && v[len(v)-1] == '.' {
+						v = v[:len(v)-1]
+					}
+				}
+			}
+		case "ip":
+			v = conn.RemoteAddr().String()
+			if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+		case "cn":
+			if tc, ok := conn.(*tls.Conn); ok {
+				if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+					v = certs[0].Subject.CommonName
+				}
+			}
+		case "client":
+			v = name
+		case "rtime":
+			e.rtime = true
+			continue
+		case "collector":
+			v, _ = os.Hostname()
+		}
+		e.fields = append(e.fields, field{key: n, value: v})
+	}
+	return e
+}
+
+// enrich returns the message msg with the missing fields added.
+func (e *enricher) enrich(msg []byte) ([]byte, error) {
+	if len(e.fields) == 0 && !e.rtime {
+		return msg, nil
+	}
+	r, err := parseRecord(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "enrich")
+	}
+	for _, f := range e.fields {
+		r.add(f.key, f.value)
+	}
+	if e.rtime {
+		r.add("rtime", time.Now().UTC().Format(time.RFC3339Nano))
+	}
+	if !r.changed {
+		return msg, nil
+	}
+	return r.encode(), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// clientQueueLen is the maximum number of messages queued by a connection
+// in the fair queue.
+const clientQueueLen = 64
+
+var (
+	// errQueueFull is returned when messages can't be queued without blocking.
+	errQueueFull = errors.New("message queue full")
+	// errQueueClosed is returned when messages are queued after close.
+	errQueueClosed = errors.New("message queue closed")
+)
+
+// fairQueue schedules the messages of the connections into the output
+// channel in round robin, so that a client sending many messages doesn't
+// starve the others. A connection whose queue is full is blocked, which
+// delays the acknowledgment of its messages.
+type fairQueue struct {
+	out    chan msgItem
+	mtx    sync.Mutex
+	cond   *sync.Cond     // signaled when a queue becomes active or the fair queue is closed
+	active []*clientQueue // queues with pending messages, in scheduling order
+	closed bool
+}
+
+// clientQueue is the queue of the messages received on a connection.
+type clientQueue struct {
+	fq     *fairQueue
+	items  []msgItem  // queued messages from items[head]
+	head   int        // index of the next message to send
+	limit  int        // maximum number of queued messages
+	active bool       // the queue is in fq.active
+	space  *sync.Cond // signaled when a message is removed from the queue
+}
+
+// newFairQueue returns a fair queue sending the messages to out.
+func newFairQueue(out chan msgItem) *fairQueue {
+	fq := &fairQueue{out: out}
+	fq.cond = sync.NewCond(&fq.mtx)
+	return fq
+}
+
+// newQueue returns the queue of a new connection.
+func (fq *fairQueue) newQueue() *clientQueue {
+	return fq.newQueueLen(clientQueueLen)
+}
+
+// newQueueLen returns a new queue holding at most limit messages.
+func (fq *fairQueue) newQueueLen(limit int) *clientQueue {
+	return &clientQueue{
+		fq:    fq,
+		items: make([]msgItem, 0, limit),
+		limit: limit,
+		space: sync.NewCond(&fq.mtx),
+	}
+}
+
+// len returns the number of queued messages. fq.mtx must be held.
+func (q *clientQueue) len() int {
+	return len(q.items) - q.head
+}
+
+// push queues the message item, and blocks while the queue is full.
+func (q *clientQueue) push(item msgItem) {
+	fq := q.fq
+	fq.mtx.Lock()
+	for q.len() >= q.limit {
+		q.space.Wait()
+	}
+	q.append(item)
+	fq.mtx.Unlock()
+}
+
+// tryPush queues all the message items without blocking, or none of them
+// and returns errQueueFull if the queue has no room for them, or
+// errQueueClosed after close. An empty queue accepts more than limit items,
+// so that any number of items can be queued.
+func (q *clientQueue) tryPush(items []msgItem) error {
+	fq := q.fq
+	fq.mtx.Lock()
+	defer fq.mtx.Unlock()
+	if fq.closed {
+		return errQueueClosed
+	}
+	if n := q.len(); n > 0 && n+len(items) > q.limit {
+		return errQueueFull
+	}
+	q.append(items...)
+	return nil
+}
+
+// append appends the message items and activates the queue. fq.mtx must be
+// held.
+func (q *clientQueue) append(items ...msgItem) {
+	if q.head > 0 && len(q.items)+len(items) > cap(q.items) {
+		// reuse the room of the sent messages
+		q.items = q.items[:copy(q.items, q.items[q.head:])]
+		q.head = 0
+	}
+	q.items = append(q.items, items...)
+	if !q.active {
+		q.active = true
+		q.fq.active = append(q.fq.active, q)
+		q.fq.cond.Signal()
+	}
+}
+
+// run sends the queued messages to the output channel, one message of each
+// active queue in turn. It closes the output channel when the fair queue is
+// closed and all queued messages are sent.
+func (fq *fairQueue) run() {
+	for {
+		fq.mtx.Lock()
+		for len(fq.active) == 0 && !fq.closed {
+			fq.cond.Wait()
+		}
+		if len(fq.active) == 0 {
+			fq.mtx.Unlock()
+			close(fq.out)
+			return
+		}
+		q := fq.active[0]
+		fq.active = fq.active[1:]
+		item := q.items[q.head]
+		q.items[q.head] = msgItem{}
+		q.head++
+		if q.len() > 0 {
+			fq.active = append(fq.active, q)
+		} else {
+			q.items, q.head = q.items[:0], 0
+			q.active = false
+		}
+		q.space.Signal()
+		fq.mtx.Unlock()
+		fq.out <- item
+	}
+}
+
+// close stops the scheduling once the queued messages are sent. No message
+// may be pushed after close.
+func (fq *fairQueue) close() {
+	fq.mtx.Lock()
+	fq.closed = true
+	fq.cond.Signal()
+	fq.mtx.Unlock()
+}
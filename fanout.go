@@ -0,0 +1,58 @@
+package main
+
+import "sync/atomic"
+
+// Overflow policies of the output queues, set by the overflow query
+// parameter of the output URLs.
+const (
+	overflowBlock = "block" // a full queue applies backpressure on the inputs
+	overflowDrop  = "drop"  // messages are dropped while the queue is full
+)
+
+// outputQueue is the buffered message queue feeding an output.
+type outputQueue struct {
+	name    string
+	msgs    chan msgItem
+	drop    bool   // messages are dropped while the queue is full
+	dropped uint64 // number of messages dropped because the queue was full
+	acks    bool   // messages are acknowledged when accepted by the output
+}
+
+// newOutputQueue returns a new outputQueue able to buffer qLen messages. The
+// messages are acknowledged with the e2eack flag.
+func newOutputQueue(name string, qLen int) *outputQueue {
+	return &outputQueue{
+		name: name,
+		msgs: make(chan msgItem, qLen),
+		acks: *e2eAckFlag,
+	}
+}
+
+// fanOut copies every message received from msgs into each output queue. A
+// full queue blocks fanOut, which applies backpressure on msgs, unless its
+// output drops messages on overflow so that it doesn't block the others.
+// Messages with an end-to-end acknowledgment are never dropped. The output
+// queues are closed when msgs is closed.
+func fanOut(msgs chan msgItem, outputs []*outputQueue) {
+	defer func() {
+		for _, o := range outputs {
+			close(o.msgs)
+		}
+	}()
+	for msg := range msgs {
+		if msg.ack != nil && len(outputs) > 1 {
+			msg.ack.setOutputs(len(outputs))
+		}
+		for _, o := range outputs {
+			if !o.drop || msg.ack != nil {
+				o.msgs <- msg
+				continue
+			}
+			select {
+			case o.msgs <- msg:
+			default:
+				atomic.AddUint64(&o.dropped, 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFanOutOverflow(t *testing.T) {
+	blocking := &outputQueue{name: "block", msgs: make(chan msgItem, 1)}
+	dropping := &outputQueue{name: "drop", msgs: make(chan msgItem, 1), drop: true}
+	msgs := make(chan msgItem)
+	done := make(chan struct{})
+	go func() {
+		fanOut(msgs, []*outputQueue{blocking, dropping})
+		close(done)
+	}()
+	msgs <- msgItem{data: []byte("first")}
+	msgs <- msgItem{data: []byte("second")}
+
+	// the second message is dropped by the full dropping queue, and waits
+	// for room in the blocking queue
+	select {
+	case msgs <- msgItem{data: []byte("third")}:
+		t.Fatal("expected fanOut blocked by the full blocking queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, want := range []string{"first", "second"} {
+		if msg := <-blocking.msgs; string(msg.data) != want {
+			t.Errorf("expected message %s, got %s", want, msg.data)
+		}
+	}
+	close(msgs)
+	<-done
+	if msg := <-dropping.msgs; string(msg.data) != "first" {
+		t.Errorf("expected message first, got %s", msg.data)
+	}
+	if _, ok := <-dropping.msgs; ok {
+		t.Error("expected the dropping queue closed")
+	}
+	if dropping.dropped != 1 || blocking.dropped != 0 {
+		t.Errorf("expected 1 message dropped by the dropping queue only, got %d and %d", dropping.dropped, blocking.dropped)
+	}
+}
+
+func TestOutputOverflow(t *testing.T) {
+	tests := []struct {
+		url    string
+		policy string
+		err    string
+	}{
+		{url: "null://", policy: overflowBlock},
+		{url: "file:///tmp/dmon.json?overflow=block", policy: overflowBlock},
+		{url: "mysql://user:pw@host/dmon?overflow=drop&table=logs", policy: overflowDrop},
+		{url: "null://?overflow=spool", err: "invalid output overflow policy 'spool', expected block or drop"},
+	}
+	for _, test := range tests {
+		policy, err := outputOverflow(test.url)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.url, test.err, err)
+			}
+			continue
+		}
+		if err != nil || policy != test.policy {
+			t.Errorf("%s: expected policy %s, got %s %v", test.url, test.policy, policy, err)
+		}
+	}
+
+	// the overflow parameter is not passed to the output
+	o, err := NewOutput("postgres://user:pw@host/db?sslmode=disable&overflow=drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred := o.(*PostgresDB).cred; cred != "postgres://user:pw@host/db?sslmode=disable" {
+		t.Errorf("expected credentials without overflow parameter, got %s", cred)
+	}
+}
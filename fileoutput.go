@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	l "log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterOutput("file", newFileOutput)
+}
+
+// fileOutput appends messages as json lines or DLCM frames to a file, that
+// may be rotated by size or time.
+type fileOutput struct {
+	template string        // file name template
+	format   string        // "json" or "dlcm"
+	maxSize  int64         // rotate when the file reaches this size, 0 for no limit
+	period   time.Duration // rotate at this period, 0 for no periodic rotation
+	compress string        // compression of rotated files: "", "gzip" or "zstd"
+	keep     int           // number of rotated files kept, 0 for no limit
+	maxAge   time.Duration // age of the deleted rotated files, 0 for no limit
+	path     string        // path of the current file
+	file     *os.File
+	w        *bufio.Writer
+	size     int64     // size of the current file
+	opened   time.Time // open time of the current file
+	seq      int       // sequence number of the current file
+	line     []byte    // buffer of the json line of a message
+	wg       sync.WaitGroup
+	log      *l.Logger
+}
+
+// newFileOutput returns an output to the file specified by u
+// (e.g. file:///var/log/dlc/{Y}{m}{d}-{H}{M}{S}.json?maxsize=100&compress=gzip).
+// The file name may contain the placeholders {Y}, {m}, {d}, {H}, {M}, {S}
+// (UTC open time of the file), {n} (sequence number) and {host}. When
+// rotating a file name without placeholders, the rotated file is renamed
+// with its open time as suffix. The query parameters are:
+//
+//	format:   json for json lines (default), dlcm for DLCM frames
+//	maxsize:  rotate when the file reaches maxsize MB
+//	period:   rotate at this period (e.g. 1h)
+//	compress: compress rotated files with gzip or zstd
+//	keep:     number of rotated files kept
+//	maxage:   delete rotated files older than maxage (e.g. 720h)
+func newFileOutput(u *url.URL) (Output, error) {
+	path := u.Path
+	if u.Host != "" {
+		path = u.Host + path // relative path (e.g. file://logs/dmon.json)
+	}
+	if path == "" {
+		return nil, errors.New("missing file path")
+	}
+	query := u.Query()
+	o := &fileOutput{
+		template: path,
+		format:   "json",
+		compress: query.Get("compress"),
+		log:      l.New(os.Stdout, "file ", l.Flags()),
+	}
+	var err error
+	if f := query.Get("format"); f != "" {
+		o.format = f
+	}
+	if o.format != "json" && o.format != "dlcm" {
+		return nil, errors.Errorf("invalid file format '%s', expected json or dlcm", o.format)
+	}
+	if v := query.Get("maxsize"); v != "" {
+		var mb int64
+		if mb, err = strconv.ParseInt(v, 10, 64); err != nil || mb < 0 {
+			return nil, errors.Errorf("invalid file maxsize '%s'", v)
+		}
+		o.maxSize = mb << 20
+	}
+	if v := query.Get("period"); v != "" {
+		if o.period, err = time.ParseDuration(v); err != nil || o.period < 0 {
+			return nil, errors.Errorf("invalid file period '%s'", v)
+		}
+	}
+	switch o.compress {
+	case "", "gzip":
+	case "zstd":
+		if _, err = exec.LookPath("zstd"); err != nil {
+			return nil, errors.Wrap(err, "zstd file compression")
+		}
+	default:
+		return nil, errors.Errorf("invalid file compression '%s', expected gzip or zstd", o.compress)
+	}
+	if v := query.Get("keep"); v != "" {
+		if o.keep, err = strconv.Atoi(v); err != nil || o.keep < 0 {
+			return nil, errors.Errorf("invalid file keep '%s'", v)
+		}
+	}
+	if v := query.Get("maxage"); v != "" {
+		if o.maxAge, err = time.ParseDuration(v); err != nil || o.maxAge < 0 {
+			return nil, errors.Errorf("invalid file maxage '%s'", v)
+		}
+	}
+	return o, nil
+}
+
+// Start opens the file in append mode.
+func (o *fileOutput) Start() error {
+	return o.open(false)
+}
+
+// open opens the current file named from the template. When fresh is true,
+// a suffix is added to the name of an existing file.
+func (o *fileOutput) open(fresh bool) error {
+	o.opened = time.Now().UTC()
+	o.path = o.fileName(o.opened)
+	if fresh {
+		path := o.path
+		for i := 1; rotatedFileExists(o.path); i++ {
+			o.path = path + "." + strconv.Itoa(i)
+		}
+	}
+	var err error
+	o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return errors.Wrap(err, "open file output")
+	}
+	info, err := o.file.Stat()
+	if err != nil {
+		o.file.Close()
+		return errors.Wrap(err, "open file output")
+	}
+	o.size = info.Size()
+	if o.w == nil {
+		o.w = bufio.NewWriterSize(o.file, 64*1024)
+	} else {
+		o.w.Reset(o.file)
+	}
+	return nil
+}
+
+// fileNamePlaceholders are the placeholders of the file name template.
+var fileNamePlaceholders = []string{"{Y}", "{m}", "{d}", "{H}", "{M}", "{S}", "{n}", "{host}"}
+
+// templated returns true if the file name template has placeholders.
+func (o *fileOutput) templated() bool {
+	for _, p := range fileNamePlaceholders {
+		if strings.Contains(o.template, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileName returns the file name of the template for a file opened at t.
+func (o *fileOutput) fileName(t time.Time) string {
+	if !o.templated() {
+		return o.template
+	}
+	host, _ := os.Hostname()
+	r := strings.NewReplacer(
+		"{Y}", t.Format("2006"), "{m}", t.Format("01"), "{d}", t.Format("02"),
+		"{H}", t.Format("15"), "{M}", t.Format("04"), "{S}", t.Format("05"),
+		"{n}", strconv.Itoa(o.seq), "{host}", host)
+	return r.Replace(o.template)
+}
+
+// Write writes json or binary encoded messages as one line json records or
+// DLCM frames, and rotates the file when required.
+func (o *fileOutput) Write(msgs [][]byte) error {
+	for _, msg := range msgs {
+		if err := o.rotateIfNeeded(); err != nil {
+			return err
+		}
+		var err error
+		if o.format == "dlcm" {
+			o.line = append(o.line[:0], "DLCM\x00\x00\x00\x00"...)
+			binary.LittleEndian.PutUint32(o.line[4:8], uint32(len(msg)))
+			o.line = append(o.line, msg...)
+		} else if o.line, err = appendJSONLine(o.line[:0], msg); err != nil {
+			return err
+		}
+		if _, err = o.w.Write(o.line); err != nil {
+			return errors.Wrap(err, "write file output")
+		}
+		o.size += int64(len(o.line))
+	}
+	return nil
+}
+
+// rotateIfNeeded rotates the file when it reached its maximum size or age.
+func (o *fileOutput) rotateIfNeeded() error {
+	if (o.maxSize == 0 || o.size < o.maxSize) && (o.period == 0 || time.Since(o.opened) < o.period) {
+		return nil
+	}
+	if o.size == 0 {
+		return nil
+	}
+	return o.rotate()
+}
+
+// rotate closes the current file, opens a new one, and compresses and deletes
+// the rotated files in the background.
+func (o *fileOutput) rotate() error {
+	if err := o.closeFile(); err != nil {
+		return err
+	}
+	rotated := o.path
+	if !o.templated() {
+		rotated = o.path + "." + o.opened.Format("20060102T150405")
+		for i := 1; rotatedFileExists(rotated); i++ {
+			rotated = fmt.Sprintf("%s.%s-%d", o.path, o.opened.Format("20060102T150405"), i)
+		}
+		if err := os.Rename(o.path, rotated); err != nil {
+			return errors.Wrap(err, "rotate file output")
+		}
+	}
+	o.seq++
+	if err := o.open(true); err != nil {
+		return err
+	}
+	o.wg.Add(1)
+	go func(rotated, current string) {
+		defer o.wg.Done()
+		if err := compressFile(rotated, o.compress); err != nil {
+			o.log.Println(err)
+		}
+		o.removeOldFiles(current)
+	}(rotated, o.path)
+	return nil
+}
+
+// closeFile flushes, syncs and closes the current file.
+func (o *fileOutput) closeFile() error {
+	if err := o.w.Flush(); err != nil {
+		return errors.Wrap(err, "flush file output")
+	}
+	if err := o.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync file output")
+	}
+	return errors.Wrap(o.file.Close(), "close file output")
+}
+
+// compressFile compresses the file at path with the compression method, and
+// removes it.
+func compressFile(path, method string) error {
+	switch method {
+	case "gzip":
+		in, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "compress file")
+		}
+		defer in.Close()
+		out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			return errors.Wrap(err, "compress file")
+		}
+		zw := gzip.NewWriter(out)
+		_, err = io.Copy(zw, in)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err == nil {
+			err = out.Sync()
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path + ".gz")
+			return errors.Wrap(err, "compress file")
+		}
+		return os.Remove(path)
+	case "zstd":
+		out, err := exec.Command("zstd", "-q", "--rm", path).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "compress file: %s", strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// rotatedFileRegexp returns the regular expression matching the paths of the
+// files named from the template, with the suffixes added when opening and
+// rotating them, compressed or not.
+func (o *fileOutput) rotatedFileRegexp() (*regexp.Regexp, error) {
+	host, _ := os.Hostname()
+	r := strings.NewReplacer(
+		`\{Y\}`, "[0-9]{4}", `\{m\}`, "[0-9]{2}", `\{d\}`, "[0-9]{2}",
+		`\{H\}`, "[0-9]{2}", `\{M\}`, "[0-9]{2}", `\{S\}`, "[0-9]{2}",
+		`\{n\}`, "[0-9]+", `\{host\}`, regexp.QuoteMeta(host))
+	expr := r.Replace(regexp.QuoteMeta(filepath.Clean(o.template))) + `(\.[0-9]+)?`
+	if !o.templated() {
+		expr += `\.[0-9]{8}T[0-9]{6}(-[0-9]+)?`
+	}
+	return regexp.Compile("^" + expr + `(\.gz|\.zst)?$`)
+}
+
+// removeOldFiles deletes the rotated files exceeding the retention limits.
+// The files named from the template, except current, are the rotated files.
+func (o *fileOutput) removeOldFiles(current string) {
+	if o.keep == 0 && o.maxAge == 0 {
+		return
+	}
+	rotatedRegexp, err := o.rotatedFileRegexp()
+	if err != nil {
+		o.log.Println("retention:", err)
+		return
+	}
+	pattern := o.template
+	for _, p := range fileNamePlaceholders {
+		pattern = strings.Replace(pattern, p, "*", -1)
+	}
+	matches, err := filepath.Glob(pattern + "*")
+	if err != nil {
+		o.log.Println("retention:", err)
+		return
+	}
+	type rotatedFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []rotatedFile
+	for _, m := range matches {
+		m = filepath.Clean(m)
+		if m == filepath.Clean(current) || !rotatedRegexp.MatchString(m) {
+			continue
+		}
+		if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+			files = append(files, rotatedFile{m, info.ModTime()})
+		}
+	}
+	// most recent first
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	for i, f := range files {
+		if (o.keep > 0 && i >= o.keep) || (o.maxAge > 0 && time.Since(f.modTime) > o.maxAge) {
+			if err := os.Remove(f.path); err != nil {
+				o.log.Println("retention:", err)
+			}
+		}
+	}
+}
+
+// Flush writes buffered messages to the file, and rotates the file when
+// its rotation period expired.
+func (o *fileOutput) Flush() error {
+	if err := o.rotateIfNeeded(); err != nil {
+		return err
+	}
+	return errors.Wrap(o.w.Flush(), "flush file output")
+}
+
+// Close flushes, syncs and closes the file, and waits for the compression
+// of rotated files.
+func (o *fileOutput) Close() error {
+	err := o.closeFile()
+	o.wg.Wait()
+	return err
+}
+
+// rotatedFileExists returns true if a file, compressed or not, exists at path.
+func rotatedFileExists(path string) bool {
+	for _, ext := range []string{"", ".gz", ".zst"} {
+		if _, err := os.Stat(path + ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
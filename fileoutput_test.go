@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveOldFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		files    []string // oldest first, the last one is the current file
+		kept     []string
+	}{
+		{
+			name:     "templated",
+			template: "{Y}{m}{d}-{H}{M}{S}.json",
+			files: []string{"a-b.json", "20261015-120000.json.gz", "20261016-120000.json.1.zst",
+				"20261016-120000.json.bak", "x20261017-110000.json", "20261017-110000.json", "20261017-120000.json"},
+			kept: []string{"20261016-120000.json.bak", "20261017-110000.json", "20261017-120000.json", "a-b.json", "x20261017-110000.json"},
+		},
+		{
+			name:     "sequence",
+			template: "dmon-{n}.json",
+			files:    []string{"dmon-.json", "dmon-1.json", "dmon-x.json", "dmon-2.json", "dmon-3.json"},
+			kept:     []string{"dmon-.json", "dmon-2.json", "dmon-3.json", "dmon-x.json"},
+		},
+		{
+			name:     "not templated",
+			template: "dmon.json",
+			files: []string{"dmon.json.old", "dmon.json.20261015T120000.gz", "dmon.json.20261016T120000-1",
+				"dmon.json.20261016T120000", "dmon.json"},
+			kept: []string{"dmon.json", "dmon.json.20261016T120000", "dmon.json.old"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			stamp := time.Now().Add(-time.Hour)
+			for _, name := range test.files {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, nil, 0660); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, stamp, stamp); err != nil {
+					t.Fatal(err)
+				}
+				stamp = stamp.Add(time.Minute)
+			}
+			o := &fileOutput{template: filepath.Join(dir, test.template), keep: 1}
+			o.removeOldFiles(filepath.Join(dir, test.files[len(test.files)-1]))
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, e := range entries {
+				kept = append(kept, e.Name())
+			}
+			sort.Strings(kept)
+			if strings.Join(kept, ",") != strings.Join(test.kept, ",") {
+				t.Errorf("expected files %q kept, got %q", test.kept, kept)
+			}
+		})
+	}
+}
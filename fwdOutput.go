@@ -4,12 +4,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
-	"encoding/hex"
 	"io"
 	l "log"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,12 +21,41 @@ import (
 const serverDNSNameCheck = true
 const maxMsgs = 10000
 
-func fwdOutput(msgs chan []byte, addresses []string, cliKey, cliCrt string, certPool *x509.CertPool) {
-	f := newFwdState(addresses, cliKey, cliCrt, certPool)
-	go f.runFlushes(flushPeriod)
-	for {
-		f.send(<-msgs)
+func init() {
+	RegisterOutput("dlc", newFwdOutput)
+}
+
+// newFwdOutput returns an output forwarding messages to the logCollectors at
+// the comma separated addresses in u (e.g. dlc://host1:3000,host2:3000). The
+// key, crt, cas, spool, spoolmax, spoolfull and deadletter query parameters
+// override the corresponding flags.
+func newFwdOutput(u *url.URL) (Output, error) {
+	if u.Host == "" {
+		return nil, errors.New("missing logCollector address")
 	}
+	q := u.Query()
+	param := func(name, defVal string) string {
+		if val := q.Get(name); val != "" {
+			return val
+		}
+		return defVal
+	}
+	certPool, err := loadCertPool(param("cas", *casFileFlag))
+	if err != nil {
+		return nil, err
+	}
+	f := newFwdState(splitAddresses(u.Host), param("key", *keyFileFlag), param("crt", *crtFileFlag), certPool)
+	f.spoolDir = param("spool", f.spoolDir)
+	f.spoolFull = param("spoolfull", f.spoolFull)
+	f.rejected = newDeadLetter(param("deadletter", f.rejected.path))
+	if val := q.Get("spoolmax"); val != "" {
+		spoolMax, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid spoolmax")
+		}
+		f.spoolMax = int64(spoolMax) << 20
+	}
+	return f, nil
 }
 
 // fwdState holds the current state of the forwarding message task.
@@ -36,7 +67,7 @@ type fwdState struct {
 	qMtx      sync.Mutex
 	bMtx      sync.Mutex
 	cond      *sync.Cond
-	msgs      [][]byte
+	msgs      [][]byte // queued messages, nil for a message rejected without sending it
 	first     int
 	last      int
 	len       int
@@ -45,6 +76,24 @@ type fwdState struct {
 	blobOut   []byte
 	log       *l.Logger
 	done      chan struct{}
+	spoolDir  string          // no spool when empty
+	spoolMax  int64           // spool size limit in bytes
+	spoolFull string          // spool overflow policy
+	spool     *spool          // nil when messages are only queued in memory
+	dropped   int             // number of messages dropped because the spool is full
+	nbrNaks   int             // number of messages rejected by the remote logCollector
+	tooLarge  int             // number of messages exceeding maxFrame, rejected without sending them
+	replayed  int             // number of queued messages reloaded from the spool, not reported accepted
+	rejected  *deadLetter     // messages rejected by the remote logCollector
+	proto1    map[string]bool // addresses of servers supporting only protocol version 1
+	welcome   *welcomeMsg     // options of the connection chosen by the server
+	maxFrame  int             // maximum message size accepted by the last server connected, 0 if unknown
+	enc       byte            // message encoding of the connection, 0 when not connected
+	zw        flushWriter     // compressor of the message stream, nil if none
+	wire      *countWriter    // counts the compressed bytes written to conn
+	stats     *Stats
+	// called with the number of messages acknowledged by the remote logCollector
+	accepted func(n int, ok bool)
 }
 
 // newFwdState creates a new fwdState instance.
@@ -58,11 +107,97 @@ func newFwdState(addresses []string, cliKey, cliCrt string, certPool *x509.CertP
 		blobIn:    make([]byte, 0, 4096),
 		blobOut:   make([]byte, 0, 4096),
 		log:       l.New(os.Stdout, "forward ", l.Flags()),
+		spoolDir:  *spoolDirFlag,
+		spoolMax:  int64(*spoolMaxFlag) << 20,
+		spoolFull: *spoolFullFlag,
+		rejected:  newDeadLetter(*deadLetterFlag),
+		proto1:    make(map[string]bool),
 	}
 	f.cond = sync.NewCond(&f.qMtx)
 	return f
 }
 
+// Start opens the spool, if any, and starts sending messages.
+func (f *fwdState) Start() error {
+	if f.spoolDir != "" {
+		if err := f.openSpool(f.spoolDir, f.spoolMax, f.spoolFull); err != nil {
+			return err
+		}
+	}
+	go f.runFlushes(flushPeriod)
+	return nil
+}
+
+// SetAccepted sets the function called when messages are acknowledged.
+// Messages are then never dropped when the spool is full.
+func (f *fwdState) SetAccepted(accepted func(n int, ok bool)) {
+	f.accepted = accepted
+}
+
+// SetStats sets the stats where the compression ratio is reported.
+func (f *fwdState) SetStats(stats *Stats) {
+	f.stats = stats
+}
+
+// Write queues the messages to send. It blocks while the queue is full.
+func (f *fwdState) Write(msgs [][]byte) error {
+	for _, msg := range msgs {
+		f.send(msg)
+	}
+	return nil
+}
+
+// Flush does nothing as queued messages are sent by runFlushes.
+func (f *fwdState) Flush() error {
+	return nil
+}
+
+// Close waits until all queued messages are acknowledged, and closes the spool.
+func (f *fwdState) Close() error {
+	f.qMtx.Lock()
+	defer f.qMtx.Unlock()
+	for f.len > 0 {
+		f.cond.Wait()
+	}
+	if f.zw != nil {
+		// terminate the compressed stream
+		f.zw.Close()
+	}
+	if err := f.rejected.close(); err != nil {
+		return err
+	}
+	if f.spool == nil {
+		return nil
+	}
+	return f.spool.close()
+}
+
+// openSpool opens the persistent spool in dir and queues the unacknowledged
+// messages it contains. They are sent by runFlushes once connected.
+func (f *fwdState) openSpool(dir string, maxSize int64, policy string) error {
+	if policy != spoolBlock && policy != spoolDrop {
+		return errors.Errorf("invalid spool overflow policy '%s'", policy)
+	}
+	s, msgs, err := openSpool(dir, maxSize)
+	if err != nil {
+		return err
+	}
+	if len(msgs) > len(f.msgs) {
+		f.msgs = make([][]byte, len(msgs))
+	}
+	copy(f.msgs, msgs)
+	f.first = 0
+	f.last = len(msgs)
+	f.len = len(msgs)
+	f.replayed = len(msgs)
+	f.spool = s
+	f.spoolFull = policy
+	if len(msgs) > 0 {
+		f.log.Printf("spool: %d unacknowledged messages to replay from %s", len(msgs), dir)
+	}
+	return nil
+}
+
 // runRecvAcks fetches acknowledgements and pops messages from the message queue.
 // Returns when an error is detected on the connection.
 func (f *fwdState) runRecvAcks() {
@@ -79,16 +214,43 @@ func (f *fwdState) runRecvAcks() {
 			close(f.done)
 			return
 		}
-		f.pop(n)
+		for i, code := range buf[:n] {
+			if code != ackCode && code != nakCode {
+				f.log.Printf("runRecvAcks error: invalid acknowledgment code %d, closing connection", code)
+				f.pop(buf[:i])
+				f.conn.Close()
+				close(f.done)
+				return
+			}
+		}
+		f.pop(buf[:n])
 	}
 }
 
 // Push adds a new message to send
 func (f *fwdState) send(msg []byte) {
 	f.qMtx.Lock()
-	for f.len == len(f.msgs) {
+	if f.maxFrame > 0 && len(msg) > f.maxFrame {
+		f.rejectTooLarge(msg)
+		return
+	}
+	block := f.spoolFull == spoolBlock || f.accepted != nil
+	for f.len == len(f.msgs) || (f.spool != nil && block && f.spool.full(len(msg))) {
 		f.cond.Wait()
 	}
+	if f.spool != nil {
+		if err := f.spool.append(msg); err != nil {
+			if err != ErrSpoolFull {
+				f.log.Fatalf("%+v", err)
+			}
+			if f.dropped%1000 == 0 {
+				f.log.Printf("spool full: dropped %d messages", f.dropped+1)
+			}
+			f.dropped++
+			f.qMtx.Unlock()
+			return
+		}
+	}
 	if f.last == len(f.msgs) {
 		f.last = 0
 	}
@@ -101,39 +263,117 @@ func (f *fwdState) send(msg []byte) {
 	f.bMtx.Unlock()
 }
 
+// rejectTooLarge moves the message msg exceeding the size limit of the server
+// to the dead letter file instead of sending it. It is acknowledged after the
+// queued messages. f.qMtx must be held, and is released.
+func (f *fwdState) rejectTooLarge(msg []byte) {
+	if err := f.rejected.write(msg); err != nil {
+		f.log.Printf("%v", err)
+	}
+	if f.tooLarge%1000 == 0 {
+		f.log.Printf("message size %d exceeds the server limit %d, moved to %s (%d in total)",
+			len(msg), f.maxFrame, f.rejected.path, f.tooLarge+1)
+	}
+	f.tooLarge++
+	for f.len == len(f.msgs) {
+		f.cond.Wait()
+	}
+	if f.len > 0 {
+		// queued without being sent, removed with the messages before it
+		if f.last == len(f.msgs) {
+			f.last = 0
+		}
+		f.msgs[f.last] = nil
+		f.last++
+		f.len++
+		f.qMtx.Unlock()
+		return
+	}
+	f.qMtx.Unlock()
+	if f.accepted != nil {
+		f.accepted(1, true)
+	}
+}
+
 func (f *fwdState) appendToBlobIn(msg []byte) {
+	if msg == nil {
+		// rejected without sending it
+		return
+	}
+	if f.enc != 0 && len(msg) > 0 && msg[0] != f.enc {
+		// the message is sent unchanged if it can't be transcoded, such as
+		// a json message with values that are not strings, as the remote
+		// logCollector accepts both encodings
+		if m, err := transcode(msg, f.enc); err == nil {
+			msg = m
+		}
+	}
 	var hdr = [8]byte{'D', 'L', 'C', 'M', 0, 0, 0, 0}
 	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(msg)))
 	f.blobIn = append(f.blobIn, hdr[:]...)
 	f.blobIn = append(f.blobIn, msg...)
 }
 
-// Pop removes n messages from front of msg queue.
-func (f *fwdState) pop(n int) {
+// Pop removes the acknowledged messages from front of msg queue. There is one
+// ackCode or nakCode in acks per message sent. Rejected messages are moved to
+// the dead letter file. The messages rejected without sending them are
+// removed with the messages before them.
+func (f *fwdState) pop(acks []byte) {
 	f.qMtx.Lock()
-	if f.len == len(f.msgs) {
-		f.cond.Signal()
+	f.cond.Broadcast()
+	var size int64
+	var naks int
+	n := 0 // number of messages removed from the queue
+	unsent := func() bool {
+		return n < f.len && f.msgs[(f.first+n)%len(f.msgs)] == nil
 	}
-	if n > f.len {
-		f.log.Fatalf("underflow: expected at most %d acks, got %d", f.len, n)
-	}
-	newFirst := f.first + n
-	if newFirst <= len(f.msgs) {
-		for i := f.first; i < newFirst; i++ {
-			f.msgs[i] = nil
+	for _, code := range acks {
+		for unsent() {
+			n++
+		}
+		if n == f.len {
+			f.log.Fatalf("underflow: got %d acks for %d queued messages", len(acks), f.len)
 		}
-	} else {
-		for i := f.first; i < len(f.msgs); i++ {
-			f.msgs[i] = nil
+		j := (f.first + n) % len(f.msgs)
+		size += int64(8 + len(f.msgs[j]))
+		if code == nakCode {
+			naks++
+			if err := f.rejected.write(f.msgs[j]); err != nil {
+				f.log.Printf("%v", err)
+			}
 		}
-		newFirst -= len(f.msgs)
-		for i := 0; i < newFirst; i++ {
-			f.msgs[i] = nil
+		f.msgs[j] = nil
+		n++
+	}
+	for unsent() {
+		n++
+	}
+	if f.spool != nil {
+		if err := f.spool.ack(size); err != nil {
+			f.log.Fatalf("%+v", err)
 		}
 	}
-	f.first = newFirst
+	f.first = (f.first + n) % len(f.msgs)
 	f.len -= n
+	f.nbrNaks += naks
+	// the messages reloaded from the spool were received before a restart,
+	// and have no sender waiting for their acknowledgment
+	accepted := n
+	if f.replayed > 0 {
+		r := f.replayed
+		if r > n {
+			r = n
+		}
+		f.replayed -= r
+		accepted -= r
+	}
 	f.qMtx.Unlock()
+	if naks > 0 {
+		f.log.Printf("%d messages rejected (%d in total), moved to %s", naks, f.nbrNaks, f.rejected.path)
+	}
+	if f.accepted != nil && accepted > 0 {
+		f.accepted(accepted, true)
+	}
 }
 
 // Flush sends queue messages and reconnect if required.
@@ -148,6 +388,8 @@ func (f *fwdState) runFlushes(flushPeriod time.Duration) {
 			f.connect()
 			f.qMtx.Lock()
 			f.bMtx.Lock()
+			f.enc = f.welcome.Encoding[0]
+			f.maxFrame = f.welcome.MaxFrame
 			f.blobIn = f.blobIn[:0]
 			if f.last > f.first {
 				for i := f.first; i < f.last; i++ {
@@ -166,12 +408,22 @@ func (f *fwdState) runFlushes(flushPeriod time.Duration) {
 			f.bMtx.Unlock()
 			f.qMtx.Unlock()
 		}
+		if f.spool != nil {
+			// messages must be in the spool before they can be acknowledged
+			f.qMtx.Lock()
+			if err := f.spool.flush(); err != nil {
+				f.log.Fatalf("%+v", err)
+			}
+		}
 		f.bMtx.Lock()
 		// swap blobIn and blobOut
 		f.blobOut = f.blobOut[:0]
 		f.blobIn, f.blobOut = f.blobOut, f.blobIn
 		f.bMtx.Unlock()
-		n, err := f.conn.Write(f.blobOut)
+		if f.spool != nil {
+			f.qMtx.Unlock()
+		}
+		n, err := f.write(f.blobOut)
 		if err == nil && n == len(f.blobOut) {
 			continue
 		}
@@ -190,6 +442,22 @@ func (f *fwdState) runFlushes(flushPeriod time.Duration) {
 	}
 }
 
+// write sends blob on the connection, compressed if negotiated with the server.
+func (f *fwdState) write(blob []byte) (int, error) {
+	if f.zw == nil {
+		return f.conn.Write(blob)
+	}
+	wire := atomic.LoadUint64(&f.wire.n)
+	n, err := f.zw.Write(blob)
+	if err == nil {
+		err = f.zw.Flush()
+	}
+	if f.stats != nil {
+		f.stats.CompressedOut(n, int(atomic.LoadUint64(&f.wire.n)-wire))
+	}
+	return n, err
+}
+
 func (f *fwdState) connect() {
 	for {
 		for _, address := range f.addresses {
@@ -223,31 +491,31 @@ func (f *fwdState) connectTo(address string) error {
 		return errors.Wrap(err, "set time out limit")
 	}
 
-	name, err := os.Hostname()
-	hdrMsg := make([]byte, 8+len(name))
-	copy(hdrMsg[:4], "DLC\x01")
-	binary.LittleEndian.PutUint32(hdrMsg[4:], uint32(len(name)))
-	copy(hdrMsg[8:], name)
-	_, err = f.conn.Write(hdrMsg)
-	if err != nil {
-		if err == io.EOF {
-			return errors.New("connect: connection closed by remote peer")
-		}
-		return errors.Wrap(err, "send connect handshake")
+	proto := 2
+	if f.proto1[address] {
+		proto = 1
+	}
+	f.welcome, err = openHandshake(f.conn, proto, newHelloMsg())
+	if err == errHandshakeClosed && proto == 2 {
+		// the server may only support protocol version 1
+		f.log.Printf("connect: %s closed the connection, retry with protocol version 1", address)
+		f.conn.Close()
+		f.proto1[address] = true
+		return f.connectTo(address)
 	}
-
-	var resp [4]byte
-	err = readAll(f.conn, resp[:])
 	if err != nil {
-		if err == io.EOF {
-			return errors.New("connect: connection closed by remote peer")
-		}
-		return errors.Wrap(err, "receive connect handshake")
+		f.conn.Close()
+		return err
 	}
-	if string(resp[:]) != "DLCS" {
-		return errors.Errorf("warning: connect: expected 'DLGS', got '%s' (0x%s)", string(resp[:]), hex.EncodeToString(resp[:]))
+	f.zw = nil
+	if f.welcome.Compression != "" {
+		f.wire = &countWriter{w: f.conn}
+		if f.zw, err = newCompressor(f.welcome.Compression, f.wire); err != nil {
+			f.conn.Close()
+			return err
+		}
 	}
 	f.conn.SetDeadline(time.Time{})
-	f.log.Println("connect:", f.conn.LocalAddr(), "->", f.conn.RemoteAddr(), "OK")
+	f.log.Println("connect:", f.conn.LocalAddr(), "->", f.conn.RemoteAddr(), "protocol", proto, f.welcome.Version, "OK")
 	return nil
 }
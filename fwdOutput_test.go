@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFwdStateRejectTooLarge(t *testing.T) {
+	f := newFwdState(nil, "", "", nil)
+	f.rejected = newDeadLetter(filepath.Join(t.TempDir(), "deadletter.dlcm"))
+	f.maxFrame = 8
+	var accepted []int
+	f.SetAccepted(func(n int, ok bool) {
+		if !ok {
+			t.Errorf("expected messages accepted")
+		}
+		accepted = append(accepted, n)
+	})
+
+	// a message too large with an empty queue is accepted at once
+	f.send([]byte("Jtoo large 1"))
+	if !reflect.DeepEqual(accepted, []int{1}) || f.len != 0 {
+		t.Fatalf("expected 1 message accepted and none queued, got %v and %d", accepted, f.len)
+	}
+
+	// otherwise it is accepted after the messages before it, without being sent
+	f.send([]byte("Jfirst"))
+	f.send([]byte("Jtoo large 2"))
+	f.send([]byte("Jtoo large 3"))
+	f.send([]byte("Jlast"))
+	if f.len != 4 {
+		t.Fatalf("expected 4 queued messages, got %d", f.len)
+	}
+	want := "DLCM\x06\x00\x00\x00JfirstDLCM\x05\x00\x00\x00Jlast"
+	if string(f.blobIn) != want {
+		t.Errorf("expected sent data %q, got %q", want, f.blobIn)
+	}
+	f.pop([]byte{ackCode})
+	if !reflect.DeepEqual(accepted, []int{1, 3}) || f.len != 1 {
+		t.Errorf("expected 3 messages accepted and 1 queued, got %v and %d", accepted, f.len)
+	}
+	f.pop([]byte{nakCode})
+	if !reflect.DeepEqual(accepted, []int{1, 3, 1}) || f.len != 0 {
+		t.Errorf("expected 1 message accepted and none queued, got %v and %d", accepted, f.len)
+	}
+	path := f.rejected.path
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var dead []string
+	err := replayFile(path, &replayStats{}, func(msg []byte) bool {
+		dead = append(dead, string(msg))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Jtoo large 1", "Jtoo large 2", "Jtoo large 3", "Jlast"}; !reflect.DeepEqual(dead, want) {
+		t.Errorf("expected dead letters %q, got %q", want, dead)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// softwareVersion is the logCollector version exchanged in the handshake.
+const softwareVersion = "logCollector 2.0"
+
+// helloMsg is the capability document sent by the client in the version 2
+// open connection handshake.
+type helloMsg struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Encodings   []string `json:"encodings"`             // supported message encodings by order of preference
+	Compression []string `json:"compression,omitempty"` // supported compressions by order of preference
+	Token       string   `json:"token,omitempty"`
+}
+
+// welcomeMsg is the reply of the server to a version 2 handshake with the
+// chosen options and its limits.
+type welcomeMsg struct {
+	Version     string `json:"version"`
+	Encoding    string `json:"encoding"`
+	Compression string `json:"compression,omitempty"`
+	MaxFrame    int    `json:"maxframe,omitempty"` // maximum accepted message size, 0 if no limit
+	Error       string `json:"error,omitempty"`
+}
+
+// ErrFrameTooLarge is returned when a frame exceeds the size limit.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// errHandshakeClosed is returned when the server closes the connection during
+// the handshake, as does a server supporting only protocol version 1.
+var errHandshakeClosed = errors.New("connect: connection closed by remote peer")
+
+// session holds the options of a connection set in the handshake.
+type session struct {
+	proto   int // protocol version
+	hello   helloMsg
+	welcome welcomeMsg
+}
+
+// serverEncodings are the message encodings accepted by the server.
+var serverEncodings = []string{"J", "B"}
+
+// serverCompressions are the compressions supported by the server.
+var serverCompressions = compressions
+
+// acceptHandshake receives the open connection handshake of a client and
+// replies to it with the limits of the listener lc. Clients using protocol
+// version 1 or 2 are accepted, unless refuse is not nil. Protocol version 2
+// clients then receive the reason of the refusal. Protocol version 1 clients
+// are refused when lc requires a token.
+func acceptHandshake(conn net.Conn, lc *listenerConfig, refuse error) (*session, error) {
+	var hdr [8]byte
+	err := readAll(conn, hdr[:4])
+	if err != nil {
+		return nil, errors.Wrap(err, "recv protocol version")
+	}
+	s := &session{}
+	switch string(hdr[:4]) {
+	case "DLC\x01":
+		s.proto = 1
+	case "DLC\x02":
+		s.proto = 2
+	default:
+		return nil, errors.Errorf("expected 'DLC\\x01' or 'DLC\\x02', got '%s\\x%02x' (0x%s)", string(hdr[:3]), hdr[3], hex.EncodeToString(hdr[:4]))
+	}
+	err = readAll(conn, hdr[4:])
+	if err != nil {
+		return nil, errors.Wrap(err, "recv protocol header")
+	}
+	initMsgLen := int(binary.LittleEndian.Uint32(hdr[4:]))
+	if initMsgLen > lc.maxName {
+		return nil, errors.Wrapf(ErrFrameTooLarge, "handshake size %d exceeds limit %d", initMsgLen, lc.maxName)
+	}
+	initMsg := make([]byte, initMsgLen)
+	err = readAll(conn, initMsg)
+	if err != nil {
+		return nil, errors.Wrap(err, "recv data")
+	}
+
+	if s.proto == 1 {
+		if refuse != nil {
+			return nil, errors.Wrapf(refuse, "refuse %s", initMsg)
+		}
+		if lc.token != "" {
+			// protocol version 1 clients can't send a token
+			return nil, errors.Errorf("reject %s: protocol version 1 not accepted when a token is required", initMsg)
+		}
+		s.hello = helloMsg{Name: string(initMsg), Encodings: []string{"J"}}
+		s.welcome = welcomeMsg{Encoding: "J"}
+		_, err = conn.Write([]byte("DLCS"))
+		return s, errors.Wrap(err, "send header")
+	}
+
+	if err = json.Unmarshal(initMsg, &s.hello); err != nil {
+		return nil, errors.Wrap(err, "decode hello")
+	}
+	s.welcome = welcomeMsg{
+		Version:     softwareVersion,
+		Encoding:    chooseOption(s.hello.Encodings, serverEncodings),
+		Compression: chooseOption(s.hello.Compression, serverCompressions),
+		MaxFrame:    lc.maxMsg,
+	}
+	var reject error
+	switch {
+	case refuse != nil:
+		reject = refuse
+	case lc.token != "" && subtle.ConstantTimeCompare([]byte(s.hello.Token), []byte(lc.token)) != 1:
+		reject = errors.New("invalid token")
+	case s.welcome.Encoding == "":
+		reject = errors.Errorf("no supported encoding in %v", s.hello.Encodings)
+	}
+	if reject != nil {
+		s.welcome.Error = reject.Error()
+	}
+	if err = sendHandshakeDoc(conn, "DLCS", &s.welcome); err != nil {
+		return nil, errors.Wrap(err, "send welcome")
+	}
+	if reject != nil {
+		return nil, errors.Wrapf(reject, "reject %s", s.hello.Name)
+	}
+	return s, nil
+}
+
+// chooseOption returns the first option in wanted that is supported, or
+// the empty string if none.
+func chooseOption(wanted, supported []string) string {
+	for _, w := range wanted {
+		for _, s := range supported {
+			if w == s {
+				return w
+			}
+		}
+	}
+	return ""
+}
+
+// sendHandshakeDoc sends a handshake header followed by the json encoded doc.
+func sendHandshakeDoc(conn net.Conn, hdr string, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 8+len(data))
+	copy(msg[:4], hdr)
+	binary.LittleEndian.PutUint32(msg[4:8], uint32(len(data)))
+	copy(msg[8:], data)
+	_, err = conn.Write(msg)
+	return err
+}
+
+// newHelloMsg returns the capability document of this client.
+func newHelloMsg() *helloMsg {
+	name, _ := os.Hostname()
+	return &helloMsg{
+		Name:        name,
+		Version:     softwareVersion,
+		Encodings:   splitAddresses(*encodingFlag),
+		Compression: splitAddresses(*compressFlag),
+		Token:       *tokenFlag,
+	}
+}
+
+// checkEncodings returns an error if a message encoding in the comma separated
+// list is unsupported.
+func checkEncodings(list string) error {
+	encodings := splitAddresses(list)
+	if len(encodings) == 0 {
+		return errors.New("no message encoding")
+	}
+	for _, e := range encodings {
+		if chooseOption([]string{e}, serverEncodings) == "" {
+			return errors.Errorf("unsupported message encoding '%s', expected one of %v", e, serverEncodings)
+		}
+	}
+	return nil
+}
+
+// openHandshake sends the open connection handshake using protocol version
+// proto, and returns the options chosen by the server.
+func openHandshake(conn net.Conn, proto int, hello *helloMsg) (*welcomeMsg, error) {
+	var err error
+	if proto == 1 {
+		hdrMsg := make([]byte, 8+len(hello.Name))
+		copy(hdrMsg[:4], "DLC\x01")
+		binary.LittleEndian.PutUint32(hdrMsg[4:], uint32(len(hello.Name)))
+		copy(hdrMsg[8:], hello.Name)
+		_, err = conn.Write(hdrMsg)
+	} else {
+		err = sendHandshakeDoc(conn, "DLC\x02", hello)
+	}
+	if err != nil {
+		if err == io.EOF {
+			return nil, errHandshakeClosed
+		}
+		return nil, errors.Wrap(err, "send connect handshake")
+	}
+
+	var resp [8]byte
+	if err = readAll(conn, resp[:4]); err != nil {
+		if err == io.EOF {
+			return nil, errHandshakeClosed
+		}
+		return nil, errors.Wrap(err, "receive connect handshake")
+	}
+	if string(resp[:4]) != "DLCS" {
+		return nil, errors.Errorf("warning: connect: expected 'DLCS', got '%s' (0x%s)", string(resp[:4]), hex.EncodeToString(resp[:4]))
+	}
+	if proto == 1 {
+		return &welcomeMsg{Encoding: "J"}, nil
+	}
+	if err = readAll(conn, resp[4:]); err != nil {
+		return nil, errors.Wrap(err, "receive connect handshake")
+	}
+	dataLen := int(binary.LittleEndian.Uint32(resp[4:]))
+	if dataLen > *maxNameFlag {
+		return nil, errors.Wrapf(ErrFrameTooLarge, "handshake size %d exceeds limit %d", dataLen, *maxNameFlag)
+	}
+	data := make([]byte, dataLen)
+	if err = readAll(conn, data); err != nil {
+		return nil, errors.Wrap(err, "receive connect handshake")
+	}
+	w := &welcomeMsg{}
+	if err = json.Unmarshal(data, w); err != nil {
+		return nil, errors.Wrap(err, "decode welcome")
+	}
+	if w.Error != "" {
+		return nil, errors.Errorf("connect: rejected by server: %s", w.Error)
+	}
+	return w, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	l "log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// httpConnKey is the context key of the connection of an HTTP request.
+type httpConnKey struct{}
+
+// httpInput receives json messages posted to an HTTPS endpoint.
+type httpInput struct {
+	msgs     *clientQueue    // queue of the messages of all clients
+	stop     <-chan struct{} // closed to interrupt the rate limit delays
+	printMsg bool
+	stats    *Stats
+	log      *l.Logger
+	requests chan struct{} // requests being processed
+}
+
+// startHTTP starts the HTTPS endpoint receiving json messages posted to
+// /messages at address. Clients are authenticated by a certificate verified
+// with config, or by a bearer token equal to the token flag. The messages are
+// queued in fq, and the rate limit delays interrupted when stop is closed. It
+// returns the server to close on shutdown, which waits for the requests being
+// processed.
+func startHTTP(address string, config *tls.Config, fq *fairQueue, stop <-chan struct{}, printMsg bool, stats *Stats) (io.Closer, error) {
+	c := config.Clone()
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+	listener, err := tls.Listen("tcp", address, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "http listen")
+	}
+	h := &httpInput{
+		msgs:     fq.newQueueLen(*httpReqsFlag * clientQueueLen),
+		stop:     stop,
+		printMsg: printMsg,
+		stats:    stats,
+		log:      l.New(os.Stdout, "http    ", l.Flags()),
+		requests: make(chan struct{}, *httpReqsFlag),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/messages", h)
+	srv := &http.Server{
+		Handler:     mux,
+		ReadTimeout: timeOutDelay,
+		IdleTimeout: timeOutDelay,
+		ErrorLog:    h.log,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, conn)
+		},
+	}
+	go func() {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			h.log.Fatalln("serve:", err)
+		}
+	}()
+	h.log.Println("listen:", address)
+	return httpServer{srv}, nil
+}
+
+// httpServer is an HTTP server closed gracefully.
+type httpServer struct {
+	*http.Server
+}
+
+// Close stops accepting requests, and waits until the requests being
+// processed are replied or the timeout delay expires.
+func (s httpServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeOutDelay)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return s.Server.Close()
+	}
+	return nil
+}
+
+// ServeHTTP queues the json object, json array of objects, or json lines
+// posted in the request body. It replies 200 once the messages are queued,
+// 413 when the body or a message exceeds the size limits, 429 when too many
+// requests are processed or the message queue is full, and 503 when the
+// server is shutting down. The messages of a request are all queued or none.
+// The reply is delayed when the client exceeds its rate limit.
+func (h *httpInput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name, ok := h.authorize(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="logCollector"`)
+		httpError(w, http.StatusUnauthorized, "client certificate or bearer token required")
+		return
+	}
+	select {
+	case h.requests <- struct{}{}:
+		defer func() { <-h.requests }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		httpError(w, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+	if r.ContentLength > int64(*httpMaxFlag) {
+		httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body size exceeds limit %d", *httpMaxFlag))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(*httpMaxFlag)))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body size exceeds limit %d", *httpMaxFlag))
+		return
+	} else if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	records, err := splitJSONRecords(body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, _ := r.Context().Value(httpConnKey{}).(net.Conn)
+	enr := newEnricher(conn, name, enrichFields)
+	msgs := make([][]byte, 0, len(records))
+	rejected := 0
+	for _, msg := range records {
+		if len(msg) > *maxMsgFlag {
+			httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("message size %d exceeds limit %d", len(msg), *maxMsgFlag))
+			return
+		}
+		err = checkMsg(msg)
+		if err == nil {
+			msg, err = enr.enrich(msg)
+		}
+		if err != nil {
+			if rejected == 0 {
+				h.log.Printf("reject message from %s: %v", name, err)
+			}
+			rejected++
+			h.stats.Reject()
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if rateLimits != nil && conn != nil {
+		// slow down the client by delaying the reply
+		bucket := rateLimits.acquire(rateLimits.clientKey(conn, name))
+		if bucket != nil {
+			if delay := bucket.wait(len(msgs), h.stop); delay > 0 {
+				h.log.Printf("rate limit of %s (%s) exceeded, delay %v", name, bucket.key, delay)
+			}
+			rateLimits.release(bucket)
+		}
+	}
+	items := make([]msgItem, len(msgs))
+	for i, msg := range msgs {
+		items[i].data = msg
+	}
+	switch err = h.msgs.tryPush(items); err {
+	case nil:
+	case errQueueFull:
+		w.Header().Set("Retry-After", "1")
+		httpError(w, http.StatusTooManyRequests, err.Error())
+		return
+	default:
+		w.Header().Set("Retry-After", "1")
+		httpError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	for _, msg := range msgs {
+		if h.printMsg {
+			h.log.Println("msg:", string(msg))
+		}
+		h.stats.Update(len(msg))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"accepted":%d,"rejected":%d}`+"\n", len(msgs), rejected)
+}
+
+// authorize returns the client name of the request r, and false if the
+// client has neither a verified certificate nor the bearer token.
+func (h *httpInput) authorize(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if *tokenFlag != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*tokenFlag)) == 1 {
+		return "http", true
+	}
+	return "", false
+}
+
+// splitJSONRecords returns the json encoded messages of the json object,
+// json array of objects, or json lines in body.
+func splitJSONRecords(body []byte) ([][]byte, error) {
+	var raws []json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		if err := dec.Decode(&raws); err != nil {
+			return nil, errors.Wrap(err, "decode json array")
+		}
+	} else {
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, errors.Wrap(err, "decode json object")
+			}
+			raws = append(raws, raw)
+		}
+	}
+	msgs := make([][]byte, 0, len(raws))
+	for _, raw := range raws {
+		if len(raw) == 0 || raw[0] != '{' {
+			return nil, errors.New("expected json objects")
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, 1+len(raw)))
+		buf.WriteByte('J')
+		if err := json.Compact(buf, raw); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, buf.Bytes())
+	}
+	return msgs, nil
+}
+
+// httpError replies to the request with the status code and a json error.
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":%s}`+"\n", appendJSONString(nil, msg))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listenerConfig holds the options of a DLC protocol listener.
+type listenerConfig struct {
+	address  string      // listen address
+	tls      *tls.Config // nil for plaintext connections
+	maxMsg   int         // maximum size in bytes of a received message
+	maxName  int         // maximum size in bytes of the handshake data
+	token    string      // token required from protocol version 2 clients
+	maxConns int         // maximum number of open connections, no limit if 0
+}
+
+// newServerTLSConfig returns the TLS config of a listener with the key and
+// certificate files, requiring client certificates signed by certPool.
+func newServerTLSConfig(keyFile, crtFile string, certPool *x509.CertPool) (*tls.Config, error) {
+	serverCert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool,
+		Rand:         rand.Reader,
+	}, nil
+}
+
+// parseListener returns the config of the listener at address, either
+// host:port for TLS with the default config and limits, or a URL:
+//
+//	dlc://host:port?key=key.pem&crt=crt.pem&cas=cas.pem&maxmsg=1048576&maxname=65536&token=secret&maxconns=1000
+//	tcp://127.0.0.1:3000?maxmsg=1048576&maxname=65536&token=secret&maxconns=1000
+//
+// The dlc scheme is a TLS listener, tcp a plaintext listener. The query
+// parameters override the default key, certificate, authorities and limits.
+// A plaintext listener must be on a loopback address, unless the query has
+// insecure=true and the listener requires a token.
+func parseListener(address string, config *tls.Config, keyFile, crtFile, casFile string) (*listenerConfig, error) {
+	lc := &listenerConfig{
+		address:  address,
+		tls:      config,
+		maxMsg:   *maxMsgFlag,
+		maxName:  *maxNameFlag,
+		token:    *tokenFlag,
+		maxConns: *maxConnsFlag,
+	}
+	if !strings.Contains(address, "://") {
+		return lc, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen address")
+	}
+	lc.address = u.Host
+	query := u.Query()
+	switch u.Scheme {
+	case "dlc":
+		key, crt, cas := query.Get("key"), query.Get("crt"), query.Get("cas")
+		if key == "" && crt == "" && cas == "" {
+			break
+		}
+		if key == "" {
+			key = keyFile
+		}
+		if crt == "" {
+			crt = crtFile
+		}
+		if cas == "" {
+			cas = casFile
+		}
+		certPool, err := loadCertPool(cas)
+		if err != nil {
+			return nil, err
+		}
+		if lc.tls, err = newServerTLSConfig(key, crt, certPool); err != nil {
+			return nil, errors.Wrapf(err, "listener %s", lc.address)
+		}
+	case "tcp":
+		lc.tls = nil
+	default:
+		return nil, errors.Errorf("invalid listen address '%s', expected dlc or tcp scheme", address)
+	}
+	for _, v := range []struct {
+		name string
+		val  *int
+		min  int
+	}{{"maxmsg", &lc.maxMsg, 1}, {"maxname", &lc.maxName, 1}, {"maxconns", &lc.maxConns, 0}} {
+		if s := query.Get(v.name); s != "" {
+			if *v.val, err = strconv.Atoi(s); err != nil || *v.val < v.min {
+				return nil, errors.Errorf("invalid listener %s '%s'", v.name, s)
+			}
+		}
+	}
+	if query.Get("token") != "" {
+		lc.token = query.Get("token")
+	}
+	if lc.tls == nil && !lc.loopback() {
+		// plaintext connections from other hosts are neither encrypted nor
+		// authenticated by a certificate
+		insecure, _ := strconv.ParseBool(query.Get("insecure"))
+		if !insecure || lc.token == "" {
+			return nil, errors.Errorf("plaintext listener %s on a non loopback address requires insecure=true and a token", lc.address)
+		}
+	}
+	return lc, nil
+}
+
+// listen returns the listener of lc.
+func (lc *listenerConfig) listen() (net.Listener, error) {
+	if lc.tls == nil {
+		return net.Listen("tcp", lc.address)
+	}
+	return tls.Listen("tcp", lc.address, lc.tls)
+}
+
+// loopback returns true if the listen address is a loopback address.
+func (lc *listenerConfig) loopback() bool {
+	host, _, err := net.SplitHostPort(lc.address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -3,50 +3,120 @@ package main
 import (
 	l "log"
 	"net"
+	"net/url"
 	"os"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
-func logstashOutput(msgs chan []byte, address string) {
-	var (
-		err  error
-		conn net.Conn
-	)
-	log := l.New(os.Stdout, "logstash", l.Flags())
-connect:
+func init() {
+	RegisterOutput("logstash", newLogstashOutput)
+}
+
+// logstashOutput sends messages as json lines to logstash.
+type logstashOutput struct {
+	rejecter // messages that can't be converted to json
+	address  string
+	conn     net.Conn
+	blob     []byte
+	nMsgs    int // number of messages in blob or dead-lettered since the last flush
+	// called with the number of messages sent or lost
+	accepted func(n int, ok bool)
+}
+
+// newLogstashOutput returns an output to the logstash tcp input specified
+// by u (e.g. logstash://mardirac.in2p3.fr:3001). The deadletter query
+// parameter is the file where the messages that can't be converted to json
+// are stored.
+func newLogstashOutput(u *url.URL) (Output, error) {
+	if u.Host == "" {
+		return nil, errors.New("missing logstash address")
+	}
+	deadLetterPath := defaultDeadLetterPath(u.Scheme)
+	if path := u.Query().Get("deadletter"); path != "" {
+		deadLetterPath = path
+	}
+	return &logstashOutput{
+		rejecter: newRejecter(deadLetterPath, l.New(os.Stdout, "logstash", l.Flags()), "message"),
+		address:  u.Host,
+		blob:     make([]byte, 0, 4096),
+	}, nil
+}
+
+// SetAccepted sets the function called when messages are sent or lost.
+func (o *logstashOutput) SetAccepted(accepted func(n int, ok bool)) {
+	o.accepted = accepted
+}
+
+// Start connects to logstash.
+func (o *logstashOutput) Start() error {
+	o.connect()
+	return nil
+}
+
+// connect connects to logstash, and retries until it succeeds.
+func (o *logstashOutput) connect() {
+	var err error
 	for {
-		for {
-			conn, err = net.Dial("tcp", address)
-			if err == nil {
-				log.Printf("connected to logstash (%s)", address)
-				break
-			}
-			log.Printf("failed connecting to logstash (%s): %v, wait 10 seconds", address, err)
-			time.Sleep(10 * time.Second)
+		o.conn, err = net.Dial("tcp", o.address)
+		if err == nil {
+			o.log.Printf("connected to logstash (%s)", o.address)
+			return
 		}
-		blob := make([]byte, 0, 4096)
-		ticker := time.NewTicker(flushPeriod)
-		for {
-			select {
-			case msg := <-msgs:
-				// drop the first character which is 'J' for json.
-				blob = append(blob, msg[1:]...)
-				blob = append(blob, '\n')
-				// normalize json encoding for logstash (one line json)
-				for i := range blob[len(blob)-len(msg) : len(blob)-1] {
-					if blob[i] == '\n' || blob[i] == '\r' {
-						blob[i] = ' '
-					}
-				}
+		o.log.Printf("failed connecting to logstash (%s): %v, wait 10 seconds", o.address, err)
+		time.Sleep(10 * time.Second)
+	}
+}
 
-			case <-ticker.C:
-				_, err = conn.Write(blob) // may block due to backpressure
-				if err != nil {
-					log.Println("failed forwarding messages to logstash:", err)
-					continue connect
+// Write appends the messages to the blob sent to logstash. The messages
+// that can't be converted to json are moved to the dead letter file.
+func (o *logstashOutput) Write(msgs [][]byte) error {
+	for _, msg := range msgs {
+		// logstash expects one line json records
+		var err error
+		if o.blob, err = appendJSONLine(o.blob, msg); err != nil {
+			dropped := o.dropped
+			o.reject(msg, err)
+			if o.dropped != dropped {
+				// report the messages before the lost one
+				o.Flush()
+				if o.accepted != nil {
+					o.accepted(1, false)
 				}
-				blob = blob[:0]
+				continue
 			}
 		}
+		o.nMsgs++
+	}
+	return nil
+}
+
+// Flush sends the blob to logstash. The blob is dropped and the output
+// reconnects when the write fails.
+func (o *logstashOutput) Flush() error {
+	var err error
+	if len(o.blob) > 0 {
+		_, err = o.conn.Write(o.blob) // may block due to backpressure
+	}
+	if o.accepted != nil && o.nMsgs > 0 {
+		o.accepted(o.nMsgs, err == nil)
+	}
+	o.blob = o.blob[:0]
+	o.nMsgs = 0
+	if err != nil {
+		o.log.Println("failed forwarding messages to logstash:", err)
+		o.conn.Close()
+		o.connect()
+	}
+	return nil
+}
+
+// Close sends the blob to logstash and closes the connection.
+func (o *logstashOutput) Close() error {
+	o.Flush()
+	if err := o.deadLetter.close(); err != nil {
+		o.log.Println(err)
 	}
+	return o.conn.Close()
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLogstashOutputReject(t *testing.T) {
+	tests := []struct {
+		name       string
+		deadLetter string // relative to a temporary directory
+		accepted   []string
+		dead       int // number of dead letters
+	}{
+		{name: "dead-lettered", deadLetter: "deadletter.dlcm", accepted: []string{"3 true"}, dead: 1},
+		{name: "lost", deadLetter: "missing/deadletter.dlcm", accepted: []string{"1 true", "1 false", "1 true"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			lines := make(chan []string)
+			go func() {
+				var received []string
+				if conn, err := ln.Accept(); err == nil {
+					s := bufio.NewScanner(conn)
+					for s.Scan() {
+						received = append(received, s.Text())
+					}
+					conn.Close()
+				}
+				lines <- received
+			}()
+
+			path := filepath.Join(t.TempDir(), test.deadLetter)
+			out, err := newLogstashOutput(&url.URL{Scheme: "logstash", Host: ln.Addr().String(), RawQuery: "deadletter=" + url.QueryEscape(path)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*logstashOutput)
+			var accepted []string
+			o.SetAccepted(func(n int, ok bool) {
+				accepted = append(accepted, fmt.Sprintf("%d %v", n, ok))
+			})
+			if err = o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.Write([][]byte{[]byte(`J{"message":"first"}`), []byte("B\x05\x00"), []byte(`J{"message":"last"}`)})
+			if err = o.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{`{"message":"first"}`, `{"message":"last"}`}; !reflect.DeepEqual(<-lines, want) {
+				t.Errorf("expected lines %q sent", want)
+			}
+			if !reflect.DeepEqual(accepted, test.accepted) {
+				t.Errorf("expected accepted %q, got %q", test.accepted, accepted)
+			}
+			if int(o.deadLetter.count) != test.dead || int(o.rejected) != test.dead {
+				t.Errorf("expected %d dead letters, got %d", test.dead, o.deadLetter.count)
+			}
+		})
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
-	"fmt"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 )
@@ -18,31 +18,184 @@ type Msg struct {
 	System    string `json:"name"`
 	Component string `json:"componentname"`
 	Message   string `json:"message"`
+	Extra     Fields `json:"-"` // additional fields (e.g. host, utime, exc_info)
 }
 
-// JSONEncode append json encoded message to buf.
+// Field is an additional field of a message.
+type Field struct {
+	Key   string
+	Value json.RawMessage // json encoded value
+}
+
+// Fields is an ordered map of additional fields.
+type Fields []Field
+
+// Get returns the json encoded value of the field key, and false if absent.
+func (fs Fields) Get(key string) (json.RawMessage, bool) {
+	for _, f := range fs {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set sets the json encoded value of the field key. A new field is appended
+// after the existing fields.
+func (fs *Fields) Set(key string, value json.RawMessage) {
+	for i := range *fs {
+		if (*fs)[i].Key == key {
+			(*fs)[i].Value = value
+			return
+		}
+	}
+	*fs = append(*fs, Field{Key: key, Value: value})
+}
+
+// AppendJSON appends the fields to buf as a json object.
+func (fs Fields) AppendJSON(buf []byte) []byte {
+	buf = append(buf, '{')
+	for i, f := range fs {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, f.Key)
+		buf = append(buf, ':')
+		buf = append(buf, f.Value...)
+	}
+	return append(buf, '}')
+}
+
+// size returns the number of bytes of the encoded fields, without separators.
+func (fs Fields) size() int {
+	n := 0
+	for _, f := range fs {
+		n += len(f.Key) + len(f.Value)
+	}
+	return n
+}
+
+// JSONEncode returns the json encoded message.
 func (m *Msg) JSONEncode() ([]byte, error) {
-	// jmsg, err := json.Marshal(m)
-	// if err != nil {
-	// 	return nil, errors.Wrap(err, "json encode")
-	// }
-	// buf := make([]byte, 0, len(jmsg)+2)
-	// buf = append(buf, 'J')
-	// return append(buf, jmsg...), nil
-	jmsg := fmt.Sprintf(`J{"asctime":"%s","levelname":"%s","name":"%s","componentname":"%s","message":"%s"}`,
-		m.Stamp, m.Level, m.System, m.Component, m.Message)
-	return []byte(jmsg), nil
+	n := 70 + len(m.Stamp) + len(m.Level) + len(m.System) + len(m.Component) + len(m.Message)
+	n += m.Extra.size() + 4*len(m.Extra)
+	return m.AppendJSON(make([]byte, 0, n)), nil
+}
+
+// AppendJSON appends the json encoded message to buf.
+func (m *Msg) AppendJSON(buf []byte) []byte {
+	buf = append(buf, `J{"asctime":`...)
+	buf = appendJSONString(buf, m.Stamp)
+	buf = append(buf, `,"levelname":`...)
+	buf = appendJSONString(buf, m.Level)
+	buf = append(buf, `,"name":`...)
+	buf = appendJSONString(buf, m.System)
+	buf = append(buf, `,"componentname":`...)
+	buf = appendJSONString(buf, m.Component)
+	buf = append(buf, `,"message":`...)
+	buf = appendJSONString(buf, m.Message)
+	for _, f := range m.Extra {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, f.Key)
+		buf = append(buf, ':')
+		buf = append(buf, f.Value...)
+	}
+	return append(buf, '}')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends the json encoded string s to buf. Invalid UTF-8
+// sequences are replaced by U+FFFD, as done by encoding/json.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are escaped for javascript compatibility
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
 }
 
-// JSONDecode decode the json encoded message in front of data.
+// JSONDecode decode the json encoded message in front of data. The fields
+// that are not message fields are stored in Extra.
 func (m *Msg) JSONDecode(data []byte) error {
-	if data[0] != 'J' {
+	if len(data) == 0 || data[0] != 'J' {
 		return ErrUnknownEncoding
 	}
-	return json.Unmarshal(data[1:], m)
+	r, err := parseRecord(data)
+	if err != nil {
+		return errors.Wrap(err, "json decode")
+	}
+	m.setRecord(r)
+	return nil
 }
 
-// BinaryEncode append binary encoded message to buf.
+// setRecord sets the message from the parsed record r.
+func (m *Msg) setRecord(r *record) {
+	*m = Msg{}
+	for i, k := range r.keys {
+		switch k {
+		case "asctime":
+			m.Stamp = r.stringValue(i)
+		case "levelname":
+			m.Level = r.stringValue(i)
+		case "name":
+			m.System = r.stringValue(i)
+		case "componentname":
+			m.Component = r.stringValue(i)
+		case "message":
+			m.Message = r.stringValue(i)
+		default:
+			v := json.RawMessage(r.values[i])
+			if r.enc == 'B' {
+				v = appendJSONString(nil, string(v))
+			}
+			m.Extra.Set(k, v)
+		}
+	}
+}
+
+// BinaryEncode append binary encoded message to buf. The values of the
+// additional fields must be json strings.
 func (m *Msg) BinaryEncode(buf []byte) ([]byte, error) {
 	buf = append(buf, 'B')
 	var b [8]byte
@@ -67,41 +220,32 @@ func (m *Msg) BinaryEncode(buf []byte) ([]byte, error) {
 	binary.LittleEndian.PutUint32(b[:4], uint32(len(m.Message)))
 	buf = append(buf, b[:4]...)
 	buf = append(buf, []byte(m.Message)...)
+	// additional fields are key value pairs of strings
+	for _, f := range m.Extra {
+		if len(f.Value) == 0 || f.Value[0] != '"' {
+			return buf, errors.Wrapf(errNotString, "binary encode field %s", f.Key)
+		}
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(f.Key)))
+		buf = append(buf, b[:4]...)
+		buf = append(buf, f.Key...)
+		v := jsonString(f.Value)
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+		buf = append(buf, b[:4]...)
+		buf = append(buf, v...)
+	}
 	return buf, nil
 }
 
-// BinaryDecode decode the binary encoded message in front of data.
+// BinaryDecode decode the binary encoded message in front of data. The
+// additional fields are stored in Extra as json strings.
 func (m *Msg) BinaryDecode(data []byte) error {
-	if data[0] != 'B' {
+	if len(data) == 0 || data[0] != 'B' {
 		return ErrUnknownEncoding
 	}
-	// l := int(data[0])
-	// data = data[1:]
-	// if err := m.Stamp.UnmarshalBinary(data[:l]); err != nil {
-	// 	return errors.Wrap(err, "binary decode")
-	// }
-	l := int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.Stamp = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.Level = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.System = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.Component = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	if l != len(data) {
-		err := errors.Errorf("expected len(data)= %d, got %d", len(data), l)
-		return errors.Wrap(err, "binary decode")
+	r, err := parseRecord(data)
+	if err != nil {
+		return err
 	}
-	m.Message = string(data)
+	m.setRecord(r)
 	return nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// validString returns s as decoded by encoding/json after encoding, with the
+// invalid UTF-8 sequences replaced by U+FFFD.
+func validString(t *testing.T, s string) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err = json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func FuzzAppendJSONString(f *testing.F) {
+	for _, s := range []string{"", "hello", `"quoted" \ back\slash`, "tab\tnew\nline\rret\x00\x1f\x7f",
+		"caf\xc3\xa9 \xff\xfe invalid \xc3", "\u2028\u2029", "<html> & 'js'", "\U0001F600 \xed\xa0\x80"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		buf := appendJSONString([]byte("prefix"), s)
+		if !bytes.HasPrefix(buf, []byte("prefix")) {
+			t.Fatalf("prefix overwritten: %q", buf)
+		}
+		enc := buf[len("prefix"):]
+		if !json.Valid(enc) {
+			t.Fatalf("invalid json %q for %q", enc, s)
+		}
+		if bytes.ContainsAny(enc, "\u2028\u2029\n\r") {
+			t.Fatalf("unescaped line separator in %q", enc)
+		}
+		var v string
+		if err := json.Unmarshal(enc, &v); err != nil {
+			t.Fatal(err)
+		}
+		if want := validString(t, s); v != want {
+			t.Fatalf("expected %q, got %q from %q", want, v, enc)
+		}
+	})
+}
+
+func FuzzMsgJSON(f *testing.F) {
+	f.Add("2026-10-17 12:00:00", "INFO", "system", "component", "message", "host", "localhost", int64(1234))
+	f.Add("", "", "", "", "", "", "", int64(0))
+	f.Add("\xff", "\"", "\\", "\n", "\u2028", "k\x00ey", "va\tlue\xc3", int64(-1))
+	f.Fuzz(func(t *testing.T, stamp, level, system, component, message, key, value string, n int64) {
+		m := &Msg{Stamp: stamp, Level: level, System: system, Component: component, Message: message}
+		switch validString(t, key) {
+		case "asctime", "levelname", "name", "componentname", "message", "n":
+		default:
+			m.Extra.Set(key, appendJSONString(nil, value))
+		}
+		m.Extra.Set("n", strconv.AppendInt(nil, n, 10))
+		buf, err := m.JSONEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) == 0 || buf[0] != 'J' || !json.Valid(buf[1:]) {
+			t.Fatalf("invalid json message %q", buf)
+		}
+		if err = checkMsg(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		// the fixed fields are json strings and the extra fields follow them
+		var fields map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(buf[1:]))
+		dec.UseNumber()
+		if err = dec.Decode(&fields); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range map[string]string{"asctime": stamp, "levelname": level, "name": system,
+			"componentname": component, "message": message} {
+			if fields[k] != validString(t, v) {
+				t.Errorf("%s: expected %q, got %#v", k, validString(t, v), fields[k])
+			}
+		}
+		if fields["n"] != json.Number(strconv.FormatInt(n, 10)) {
+			t.Errorf("n: expected %d, got %#v", n, fields["n"])
+		}
+		if len(fields) != 5+len(m.Extra) {
+			t.Errorf("expected %d fields, got %d", 5+len(m.Extra), len(fields))
+		}
+
+		var d Msg
+		if err = d.JSONDecode(buf); err != nil {
+			t.Fatal(err)
+		}
+		want := Msg{Stamp: validString(t, stamp), Level: validString(t, level), System: validString(t, system),
+			Component: validString(t, component), Message: validString(t, message)}
+		for _, f := range m.Extra {
+			want.Extra.Set(validString(t, f.Key), f.Value)
+		}
+		if !reflect.DeepEqual(d, want) {
+			t.Errorf("expected decoded message %+v, got %+v", want, d)
+		}
+	})
+}
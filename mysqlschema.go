@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// mysqlMigration is a step of the schema migration of the message table.
+// A step must succeed when applied again after a partial failure.
+type mysqlMigration func(db *sql.DB, table string) error
+
+// mysqlMigrations are the schema migrations by increasing version. The
+// schema version of a table is stored in the table <table>_schema.
+var mysqlMigrations = []mysqlMigration{
+	// 1: initial schema
+	func(db *sql.DB, table string) error {
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				mid BIGINT NOT NULL AUTO_INCREMENT,
+				stamp DATETIME NOT NULL,
+				level VARCHAR(5) NOT NULL,
+				system VARCHAR(128) NOT NULL,
+				component VARCHAR(64) NOT NULL,
+				message VARCHAR(256) NOT NULL,
+				PRIMARY KEY (mid)
+			) ENGINE=INNODB
+		`, table))
+		return err
+	},
+	// 2: additional message fields
+	func(db *sql.DB, table string) error {
+		return mysqlAddColumn(db, table, "extra", "JSON NULL")
+	},
+	// 3: enrichment fields
+	func(db *sql.DB, table string) error {
+		if err := mysqlAddColumn(db, table, "host", "VARCHAR(255) NULL"); err != nil {
+			return err
+		}
+		if err := mysqlAddColumn(db, table, "utime", "BIGINT NULL"); err != nil {
+			return err
+		}
+		return mysqlAddColumn(db, table, "received_at", "DATETIME(6) NULL")
+	},
+	// 4: widen the columns truncating long values
+	func(db *sql.DB, table string) error {
+		_, err := db.Exec(fmt.Sprintf(`
+			ALTER TABLE %s
+				MODIFY level VARCHAR(16) NOT NULL,
+				MODIFY system VARCHAR(255) NOT NULL,
+				MODIFY component VARCHAR(255) NOT NULL,
+				MODIFY message TEXT NOT NULL
+		`, table))
+		return err
+	},
+	// 5: indexes of the searched columns
+	func(db *sql.DB, table string) error {
+		for _, column := range []string{"stamp", "system", "component"} {
+			if err := mysqlAddIndex(db, table, column); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// migrateMysqlSchema creates the message table or migrates its schema to the
+// latest version.
+func migrateMysqlSchema(db *sql.DB, table string) error {
+	if !sqlTableRegexp.MatchString(table) {
+		return errors.Errorf("invalid table name '%s'", table)
+	}
+	versionTable := table + "_schema"
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INT NOT NULL) ENGINE=INNODB", versionTable))
+	if err != nil {
+		return errors.Wrap(err, "create schema version table")
+	}
+	var version sql.NullInt64
+	err = db.QueryRow(fmt.Sprintf("SELECT MAX(version) FROM %s", versionTable)).Scan(&version)
+	if err != nil {
+		return errors.Wrap(err, "get schema version")
+	}
+	for v := int(version.Int64); v < len(mysqlMigrations); v++ {
+		if err = mysqlMigrations[v](db, table); err != nil {
+			return errors.Wrapf(err, "migrate table %s to schema version %d", table, v+1)
+		}
+		if _, err = db.Exec(fmt.Sprintf("INSERT INTO %s (version) VALUES (?)", versionTable), v+1); err != nil {
+			return errors.Wrap(err, "set schema version")
+		}
+	}
+	return nil
+}
+
+// mysqlAddColumn adds the column with the definition def if not yet present.
+func mysqlAddColumn(db *sql.DB, table, column, def string) error {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
+
+// mysqlAddIndex adds the index <table>_<column> on column if not yet present.
+func mysqlAddIndex(db *sql.DB, table, column string) error {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+	`, table, table+"_"+column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("CREATE INDEX %s_%s ON %s (%s)", table, column, table, column))
+	return err
+}
@@ -1,7 +1,20 @@
 package main
 
-func noOutput(msgs chan []byte) {
-	for {
-		<-msgs
-	}
+import "net/url"
+
+func init() {
+	RegisterOutput("null", newNoOutput)
 }
+
+// noOutput discards messages.
+type noOutput struct{}
+
+// newNoOutput returns an output discarding messages (null://).
+func newNoOutput(u *url.URL) (Output, error) {
+	return noOutput{}, nil
+}
+
+func (noOutput) Start() error              { return nil }
+func (noOutput) Write(msgs [][]byte) error { return nil }
+func (noOutput) Flush() error              { return nil }
+func (noOutput) Close() error              { return nil }
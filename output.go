@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	l "log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Output is a message sink.
+type Output interface {
+	// Start prepares the output to receive messages.
+	Start() error
+	// Write queues a batch of messages. The output may keep the messages,
+	// but not the msgs slice.
+	Write(msgs [][]byte) error
+	// Flush sends the queued messages to their destination.
+	Flush() error
+	// Close flushes the queued messages and releases the output resources.
+	Close() error
+}
+
+// ackOutput is implemented by outputs reporting when the written messages are
+// durably accepted. The function set by SetAccepted is called with the number
+// of messages accepted (ok is true) or lost, in write order.
+type ackOutput interface {
+	SetAccepted(accepted func(n int, ok bool))
+}
+
+// statsOutput is implemented by outputs reporting stats.
+type statsOutput interface {
+	SetStats(stats *Stats)
+}
+
+// flushPeriodOutput is implemented by outputs that need a flush period
+// other than flushPeriod.
+type flushPeriodOutput interface {
+	FlushPeriod() time.Duration
+}
+
+// OutputFactory returns a new Output configured by u.
+type OutputFactory func(u *url.URL) (Output, error)
+
+var outputFactories = map[string]OutputFactory{}
+
+// RegisterOutput registers the factory of the outputs with the given URL scheme.
+func RegisterOutput(scheme string, factory OutputFactory) {
+	if _, ok := outputFactories[scheme]; ok {
+		panic("output scheme " + scheme + " registered twice")
+	}
+	outputFactories[scheme] = factory
+}
+
+// NewOutput returns the output specified by rawURL.
+func NewOutput(rawURL string) (Output, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "new output")
+	}
+	// the overflow policy is the one of the output queue
+	if query := u.Query(); query["overflow"] != nil {
+		query.Del("overflow")
+		u.RawQuery = query.Encode()
+	}
+	factory, ok := outputFactories[u.Scheme]
+	if !ok {
+		return nil, errors.Errorf("new output: unknown scheme '%s' in '%s' (expected one of %s)",
+			u.Scheme, rawURL, strings.Join(outputSchemes(), ", "))
+	}
+	o, err := factory(u)
+	return o, errors.Wrapf(err, "new output '%s'", u.Scheme)
+}
+
+// outputOverflow returns the overflow policy of the queue of the output
+// specified by rawURL, set by its overflow query parameter. The default
+// policy is overflowBlock.
+func outputOverflow(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrap(err, "output overflow")
+	}
+	switch policy := u.Query().Get("overflow"); policy {
+	case "":
+		return overflowBlock, nil
+	case overflowBlock, overflowDrop:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid output overflow policy '%s', expected block or drop", policy)
+	}
+}
+
+// outputSchemes returns the sorted list of registered output schemes.
+func outputSchemes() []string {
+	schemes := make([]string, 0, len(outputFactories))
+	for scheme := range outputFactories {
+		schemes = append(schemes, scheme+"://")
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// runOutput writes the messages received in q to o by batches of at most
+// batchLen messages, and flushes o periodically. It closes o and returns when
+// q is closed. When q.acks is true, messages are acknowledged when
+// o accepts them, or when flushed if o is not an ackOutput.
+func runOutput(o Output, q *outputQueue, batchLen int, stats *Stats) {
+	log := l.New(os.Stdout, "output ", l.Flags())
+	if so, ok := o.(statsOutput); ok {
+		so.SetStats(stats)
+	}
+	var acks *ackQueue
+	ao, isAckOutput := o.(ackOutput)
+	if q.acks {
+		acks = &ackQueue{}
+		if isAckOutput {
+			ao.SetAccepted(acks.accepted)
+		}
+	}
+	if err := o.Start(); err != nil {
+		log.Fatalf("%s: %+v", q.name, err)
+	}
+	period := flushPeriod
+	if fpo, ok := o.(flushPeriodOutput); ok {
+		period = fpo.FlushPeriod()
+	}
+	ticker := time.NewTicker(period)
+	batch := make([][]byte, 0, batchLen)
+	batchAcks := make([]*msgAck, 0, batchLen)
+	write := func() {
+		if acks != nil {
+			acks.push(batchAcks...) // before Write that may accept the messages
+		}
+		if err := o.Write(batch); err != nil {
+			log.Printf("%s: %v", q.name, err)
+			if acks != nil && !isAckOutput {
+				acks.accepted(acks.len(), false)
+			}
+		}
+		batch = batch[:0]
+		batchAcks = batchAcks[:0]
+	}
+	flush := func() {
+		err := o.Flush()
+		if err != nil {
+			log.Printf("%s: %v", q.name, err)
+		}
+		if acks != nil && !isAckOutput {
+			acks.accepted(acks.len(), err == nil)
+		}
+	}
+	for {
+		select {
+		case msg, ok := <-q.msgs:
+			if !ok {
+				// the queue is closed on shutdown
+				if len(batch) > 0 {
+					write()
+				}
+				if acks != nil && !isAckOutput {
+					flush()
+				}
+				if err := o.Close(); err != nil {
+					log.Printf("%s: close: %v", q.name, err)
+				}
+				ticker.Stop()
+				return
+			}
+			batch = append(batch, msg.data)
+			batchAcks = append(batchAcks, msg.ack)
+			if len(batch) == cap(batch) {
+				write()
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				write()
+			}
+			flush()
+		}
+	}
+}
+
+// outputName returns the name identifying the output specified by rawURL in
+// logs and stats. The password, if any, is removed.
+func outputName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// loadCertPool returns the certificate pool of the certificate authorities
+// in casFile.
+func loadCertPool(casFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(casFile)
+	if err != nil {
+		return nil, err
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("failed to parse rootCA certificate '%s'", casFile)
+	}
+	return certPool, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeDriverName is the name of the fake database/sql driver.
+const fakeDriverName = "fakesql"
+
+func init() {
+	sql.Register(fakeDriverName, fakeDriver{})
+}
+
+// fakeDatabases are the databases of the fake driver by data source name.
+var fakeDatabases = struct {
+	sync.Mutex
+	m map[string]*fakeDatabase
+}{m: make(map[string]*fakeDatabase)}
+
+// fakeDatabase records the statements executed by the connections of the fake
+// driver. A statement with a "reject" argument fails.
+type fakeDatabase struct {
+	mtx   sync.Mutex
+	execs []fakeExec
+	fails int // number of next statements and pings failing as if the database was unreachable
+}
+
+// fakeExec is a statement executed by the fake driver.
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+// newFakeDatabase returns the new fake database of the data source name dsn.
+func newFakeDatabase(dsn string) *fakeDatabase {
+	fakeDatabases.Lock()
+	defer fakeDatabases.Unlock()
+	fakeDatabases.m[dsn] = &fakeDatabase{}
+	return fakeDatabases.m[dsn]
+}
+
+// inserts returns the INSERT statements executed.
+func (d *fakeDatabase) inserts() []fakeExec {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var inserts []fakeExec
+	for _, e := range d.execs {
+		if strings.HasPrefix(e.query, "INSERT") {
+			inserts = append(inserts, e)
+		}
+	}
+	return inserts
+}
+
+// unreachable returns an error if the database is unreachable.
+func (d *fakeDatabase) unreachable() error {
+	if d.fails > 0 {
+		d.fails--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakeDatabases.Lock()
+	defer fakeDatabases.Unlock()
+	d := fakeDatabases.m[dsn]
+	if d == nil {
+		return nil, errors.Errorf("unknown database %s", dsn)
+	}
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDatabase
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.d, query}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+func (c fakeConn) Ping(ctx context.Context) error {
+	c.d.mtx.Lock()
+	defer c.d.mtx.Unlock()
+	return c.d.unreachable()
+}
+
+type fakeStmt struct {
+	d     *fakeDatabase
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mtx.Lock()
+	defer s.d.mtx.Unlock()
+	if err := s.d.unreachable(); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if arg == "reject" {
+			return nil, errors.New("value rejected")
+		}
+	}
+	s.d.execs = append(s.d.execs, fakeExec{s.query, args})
+	return driver.RowsAffected(len(args) / 9), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries not supported")
+}
+
+// testMessage returns the json encoded message with the text message and the
+// extra fields host, utime and the field key with value.
+func testMessage(t *testing.T, message string, extra bool) []byte {
+	m := &Msg{Stamp: "2026-10-17 12:00:00", Level: "INFO", System: "system", Component: "component", Message: message}
+	m.Extra.Set("host", appendJSONString(nil, "host1"))
+	m.Extra.Set("utime", []byte("1234"))
+	if extra {
+		m.Extra.Set("key", appendJSONString(nil, "value"))
+	}
+	buf, err := m.JSONEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// newTestPostgresDB returns a PostgresDB writing in a new fake database.
+func newTestPostgresDB(t *testing.T, extra bool, bufLen int) (*PostgresDB, *fakeDatabase, *[2]int) {
+	fake := newFakeDatabase(t.Name())
+	db := NewPostgresDB(t.Name(), "dmon", filepath.Join(t.TempDir(), "deadletter.dlcm"), extra, bufLen)
+	db.driver = fakeDriverName
+	var accepted [2]int // messages accepted and lost
+	db.SetAccepted(func(n int, ok bool) {
+		if ok {
+			accepted[0] += n
+		} else {
+			accepted[1] += n
+		}
+	})
+	if err := db.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return db, fake, &accepted
+}
+
+func TestPostgresOutput(t *testing.T) {
+	db, fake, accepted := newTestPostgresDB(t, true, 10)
+	if n := len(fake.execs); n != 4 || !strings.Contains(fake.execs[0].query, "CREATE TABLE IF NOT EXISTS dmon (") {
+		t.Fatalf("expected the table and its 3 indexes created, got %d statements", n)
+	}
+
+	bin, err := (&Msg{Stamp: "2026-10-17 12:00:01", Level: "ERROR", Message: "binary"}).BinaryEncode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Write([][]byte{testMessage(t, "json", true), bin})
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	inserts := fake.inserts()
+	if len(inserts) != 1 {
+		t.Fatalf("expected 1 insert, got %d", len(inserts))
+	}
+	query := "INSERT INTO dmon (stamp, level, system, component, message, host, utime, received_at, extra) VALUES " +
+		"($1,$2,$3,$4,$5,$6,$7,$8,$9),($10,$11,$12,$13,$14,$15,$16,$17,$18)"
+	if inserts[0].query != query {
+		t.Errorf("expected query %s, got %s", query, inserts[0].query)
+	}
+	args := inserts[0].args
+	if len(args) != 18 {
+		t.Fatalf("expected 18 arguments, got %d", len(args))
+	}
+	receivedAt := args[7]
+	if _, ok := receivedAt.(time.Time); !ok {
+		t.Fatalf("expected reception time, got %#v", receivedAt)
+	}
+	want := []driver.Value{
+		time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), "INFO", "system", "component", "json", "host1", int64(1234), receivedAt, `{"key":"value"}`,
+		time.Date(2026, 10, 17, 12, 0, 1, 0, time.UTC), "ERROR", "", "", "binary", nil, nil, receivedAt, nil,
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected arguments %v, got %v", want, args)
+	}
+	if *accepted != [2]int{2, 0} {
+		t.Errorf("expected 2 messages accepted, got %v", *accepted)
+	}
+}
+
+func TestPostgresOutputWithoutExtra(t *testing.T) {
+	db, fake, _ := newTestPostgresDB(t, false, 10)
+	db.Write([][]byte{testMessage(t, "json", true)})
+	db.Flush()
+	inserts := fake.inserts()
+	if len(inserts) != 1 || len(inserts[0].args) != 9 {
+		t.Fatalf("expected 1 insert of 9 arguments, got %v", inserts)
+	}
+	if extra := inserts[0].args[8]; extra != nil {
+		t.Errorf("expected null extra column, got %#v", extra)
+	}
+}
+
+func TestPostgresOutputReject(t *testing.T) {
+	defer func(retries int) { *dbRetryFlag = retries }(*dbRetryFlag)
+	*dbRetryFlag = 0
+	db, fake, accepted := newTestPostgresDB(t, true, 10)
+	invalid := []byte("J{not json")
+	db.Write([][]byte{testMessage(t, "first", false), testMessage(t, "reject", false), invalid, testMessage(t, "last", false)})
+	db.Flush()
+
+	// the batch fails, then its rows are inserted one by one
+	var messages []string
+	for _, e := range fake.inserts() {
+		messages = append(messages, e.args[4].(string))
+	}
+	if strings.Join(messages, ",") != "first,last" {
+		t.Errorf("expected rows first and last inserted one by one, got %v", messages)
+	}
+	if db.rejected != 2 || db.dropped != 0 {
+		t.Errorf("expected 2 rows dead-lettered and none dropped, got %d and %d", db.rejected, db.dropped)
+	}
+	if *accepted != [2]int{4, 0} {
+		t.Errorf("expected 4 messages accepted, got %v", *accepted)
+	}
+	path := db.deadLetter.path
+	db.Close()
+	var dead []string
+	err := replayFile(path, &replayStats{}, func(msg []byte) bool {
+		dead = append(dead, string(msg))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{string(invalid), string(testMessage(t, "reject", false))}; !reflect.DeepEqual(dead, want) {
+		t.Errorf("expected dead letters %q, got %q", want, dead)
+	}
+}
+
+func TestPostgresOutputUnreachable(t *testing.T) {
+	db, fake, accepted := newTestPostgresDB(t, true, 10)
+	fake.fails = 2 // the insert and the ping
+	db.Write([][]byte{testMessage(t, "first", false), testMessage(t, "second", false)})
+	db.Flush()
+	inserts := fake.inserts()
+	if len(inserts) != 1 || len(inserts[0].args) != 18 {
+		t.Fatalf("expected 1 insert of 2 rows after reconnection, got %v", inserts)
+	}
+	if db.retried != 2 || db.rejected != 0 {
+		t.Errorf("expected 2 rows retried and none dead-lettered, got %d and %d", db.retried, db.rejected)
+	}
+	if *accepted != [2]int{2, 0} {
+		t.Errorf("expected 2 messages accepted, got %v", *accepted)
+	}
+}
+
+func TestPostgresOutputMaxRows(t *testing.T) {
+	db, fake, _ := newTestPostgresDB(t, true, postgresMaxRows+1)
+	msg := testMessage(t, "json", false)
+	for i := 0; i <= postgresMaxRows; i++ {
+		db.Write([][]byte{msg})
+	}
+	db.Flush()
+	inserts := fake.inserts()
+	if len(inserts) != 2 || len(inserts[0].args) != 9*postgresMaxRows || len(inserts[1].args) != 9 {
+		t.Fatalf("expected inserts of %d and 1 rows, got %d inserts", postgresMaxRows, len(inserts))
+	}
+	if !strings.HasSuffix(inserts[1].query, "VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)") {
+		t.Errorf("expected parameters numbered from 1, got %s", inserts[1].query)
+	}
+}
+
+func TestNewPostgresOutput(t *testing.T) {
+	tests := []struct {
+		url        string
+		cred       string
+		table      string
+		extra      bool
+		deadLetter string
+		err        string
+	}{
+		{url: "postgres://", table: "dmon", extra: true, deadLetter: "deadletter-postgres.dlcm"},
+		{url: "postgres:///?table=logs&extra=none", table: "logs", deadLetter: "deadletter-postgres.dlcm"},
+		{url: "postgres://user:pw@host:5432/db?sslmode=verify-full&table=logs&deadletter=pg.dlcm&extra=jsonb",
+			cred: "postgres://user:pw@host:5432/db?sslmode=verify-full", table: "logs", extra: true, deadLetter: "pg.dlcm"},
+		{url: "postgresql://host/db", cred: "postgresql://host/db", table: "dmon", extra: true, deadLetter: "deadletter-postgresql.dlcm"},
+		{url: "postgres://host/db?table=drop%20table", err: "invalid postgres table name 'drop table'"},
+		{url: "postgres://host/db?extra=json", err: "invalid postgres extra option 'json', expected jsonb or none"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := newPostgresOutput(u)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.url, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		db := o.(*PostgresDB)
+		if db.cred != test.cred || db.table != test.table || db.extra != test.extra {
+			t.Errorf("%s: expected %q %q %v, got %q %q %v", test.url, test.cred, test.table, test.extra, db.cred, db.table, db.extra)
+		}
+		if db.deadLetter.path != test.deadLetter {
+			t.Errorf("%s: expected dead letter file %s, got %s", test.url, test.deadLetter, db.deadLetter.path)
+		}
+	}
+}
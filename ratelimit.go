@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rateKeys are the client properties the rate limits can be keyed by.
+var rateKeys = []string{"name", "cn", "ip"}
+
+// rateRule is the rate limit of the clients with a key matching pattern.
+type rateRule struct {
+	pattern string  // glob pattern of the client keys
+	rate    float64 // messages per second
+	burst   float64 // messages received at once
+}
+
+// rateLimiter holds the token buckets of the clients. Connections of clients
+// with the same key share the same bucket.
+type rateLimiter struct {
+	key     string // client property keying the buckets
+	rules   []rateRule
+	mtx     sync.Mutex
+	buckets map[string]*tokenBucket
+	sweep   int // number of buckets above which the unused full buckets are removed
+}
+
+// rateLimits are the rate limits of the clients, set from the client rate
+// flag. There is no limit when nil.
+var rateLimits *rateLimiter
+
+// parseRateLimits returns the rate limiter of the comma separated limits
+// pattern=rate[:burst], keyed by key. The first rule with a pattern matching
+// the key of a client applies, and clients matching no rule are not limited.
+// The burst defaults to one second of messages.
+func parseRateLimits(list, key string) (*rateLimiter, error) {
+	if chooseOption([]string{key}, rateKeys) == "" {
+		return nil, errors.Errorf("unknown rate key '%s', expected one of %v", key, rateKeys)
+	}
+	r := &rateLimiter{key: key, buckets: make(map[string]*tokenBucket)}
+	for _, limit := range splitAddresses(list) {
+		i := strings.LastIndexByte(limit, '=')
+		if i < 0 {
+			return nil, errors.Errorf("invalid rate limit '%s', expected pattern=rate[:burst]", limit)
+		}
+		rule := rateRule{pattern: limit[:i]}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "rate limit pattern '%s'", rule.pattern)
+		}
+		rate, burst := limit[i+1:], ""
+		if j := strings.IndexByte(rate, ':'); j >= 0 {
+			rate, burst = rate[:j], rate[j+1:]
+		}
+		var err error
+		if rule.rate, err = strconv.ParseFloat(rate, 64); err != nil || rule.rate <= 0 {
+			return nil, errors.Errorf("invalid rate in rate limit '%s'", limit)
+		}
+		rule.burst = rule.rate
+		if burst != "" {
+			if rule.burst, err = strconv.ParseFloat(burst, 64); err != nil || rule.burst < 1 {
+				return nil, errors.Errorf("invalid burst in rate limit '%s'", limit)
+			}
+		}
+		r.rules = append(r.rules, rule)
+	}
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// clientKey returns the key of the client name connected to conn. The key of
+// a client without certificate is its IP address.
+func (r *rateLimiter) clientKey(conn net.Conn, name string) string {
+	if r.key == "cn" {
+		if tc, ok := conn.(*tls.Conn); ok {
+			if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+				return certs[0].Subject.CommonName
+			}
+		}
+	}
+	return r.addrKey(conn.RemoteAddr(), name)
+}
+
+// addrKey returns the key of the client name without certificate sending
+// from addr.
+func (r *rateLimiter) addrKey(addr net.Addr, name string) string {
+	if r.key == "name" {
+		return name
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// acquire returns the bucket of the client key, or nil if the client is not
+// limited. The bucket must be released when the connection is closed.
+func (r *rateLimiter) acquire(key string) *tokenBucket {
+	if r == nil {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if b := r.buckets[key]; b != nil {
+		b.refs++
+		return b
+	}
+	if len(r.buckets) >= r.sweep {
+		for k, b := range r.buckets {
+			if b.refs == 0 && b.full() {
+				delete(r.buckets, k)
+			}
+		}
+		r.sweep = 2*len(r.buckets) + 64
+	}
+	for _, rule := range r.rules {
+		if ok, _ := path.Match(rule.pattern, key); ok {
+			b := &tokenBucket{key: key, rate: rule.rate, burst: rule.burst, tokens: rule.burst, last: time.Now(), refs: 1}
+			r.buckets[key] = b
+			return b
+		}
+	}
+	return nil
+}
+
+// release releases the bucket b acquired by a connection. An unused bucket
+// is kept until it is full again, so that a client reconnecting or sending
+// a new request doesn't get a full bucket.
+func (r *rateLimiter) release(b *tokenBucket) {
+	if b == nil {
+		return
+	}
+	r.mtx.Lock()
+	if b.refs--; b.refs == 0 && b.full() {
+		delete(r.buckets, b.key)
+	}
+	r.mtx.Unlock()
+}
+
+// tokenBucket limits the message rate of a client.
+type tokenBucket struct {
+	key    string
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens
+	mtx    sync.Mutex
+	tokens float64 // available tokens, negative when reserved in advance
+	last   time.Time
+	refs   int // number of connections using the bucket, protected by the rateLimiter mutex
+}
+
+// full returns true if the bucket holds burst tokens.
+func (b *tokenBucket) full() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.tokens+time.Since(b.last).Seconds()*b.rate >= b.burst
+}
+
+// refill adds the tokens accumulated since the last update. b.mtx must be
+// held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes n tokens, and returns the delay to wait before the tokens are
+// available.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes n tokens if they are available, and returns false without
+// taking any otherwise.
+func (b *tokenBucket) allow(n int) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// wait takes n tokens, and waits until they are available or stop is closed.
+// It returns the delay waited for.
+func (b *tokenBucket) wait(n int, stop <-chan struct{}) time.Duration {
+	delay := b.take(n)
+	if delay <= 0 {
+		return 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+	return delay
+}
@@ -3,105 +3,127 @@ package main
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	l "log"
 	"net"
 	"os"
-	"strings"
+	"regexp"
+	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
-func receiveMsg(conn net.Conn, msgs chan []byte, printMsg bool, stats *Stats) {
+// receiveMsg receives the messages of a client connected to the listener lc,
+// and queues them in the fair queue fq. The rate limit delays are interrupted
+// when stop is closed.
+func receiveMsg(conn net.Conn, lc *listenerConfig, fq *fairQueue, stop <-chan struct{}, printMsg bool, stats *Stats) {
 	var (
 		hdr       [8]byte
 		err       error
 		log       = l.New(os.Stdout, "receive ", l.Flags())
-		acks      = make(chan byte, 1000)
+		acks      = make(chan byte, maxMsgs) // a client has at most maxMsgs unacknowledged messages
+		acksDone  chan struct{}              // closed when pending acknowledgments are sent
+		win       *ackWindow                 // nil when acknowledging on reception
+		rejects   int
+		throttles int
+		bucket    *tokenBucket // nil when the client rate is not limited
+		msgs      = fq.newQueue()
 		name      = "???"
-		host      = "???"
 		localhost = "???"
 	)
 	defer func() {
+		if win != nil {
+			// wait until the outputs accepted the received messages
+			win.wait(timeOutDelay)
+			win.close()
+		} else {
+			close(acks)
+		}
+		if acksDone != nil {
+			<-acksDone
+		}
 		conn.Close()
-		close(acks)
+		rateLimits.release(bucket)
 		log.Println("closing connection with", name)
-		utime := time.Now().UnixNano() / 1000
-		msgs <- []byte(fmt.Sprintf(`J{"asctime":"%s","levelname":"INFO","componentname":"logCollector","customname":"","message":"close connection","spacer":" with ","varmessage":"%s","host":"%s","utime":%d}`, time.Now().UTC().Format("2006-01-02 15:04:05"), name, localhost, utime))
+		msgs.push(msgItem{data: connectionEvent("close connection", name, localhost)})
 	}()
 
 	// open connection handshake
 	conn.SetDeadline(time.Now().Add(timeOutDelay))
-	err = readAll(conn, hdr[:4])
-	if err != nil {
-		log.Println("open connection: recv protocol version:", err)
-		return
-	}
-	if string(hdr[:4]) != "DLC\x01" { // protocol version 1
-		log.Printf("open connection: expected 'DLC\\x01', got '%s\\x%02x' (0x%s)", string(hdr[:3]), hdr[3], hex.EncodeToString(hdr[:4]))
-		return
-	}
-	err = readAll(conn, hdr[4:])
+	sess, err := acceptHandshake(conn, lc, nil)
 	if err != nil {
-		log.Println("open connection: recv protocol header:", err)
-		return
-	}
-	initMsgLen := int(binary.LittleEndian.Uint32(hdr[4:]))
-	initMsg := make([]byte, initMsgLen)
-	err = readAll(conn, initMsg)
-	if err != nil {
-		log.Println("message: recv data:", err)
-		return
-	}
-	name = string(initMsg)
-	_, err = conn.Write([]byte("DLCS"))
-	if err != nil {
-		log.Println("open connection: send header:", err)
+		if errors.Cause(err) == ErrFrameTooLarge {
+			stats.Reject()
+		}
+		log.Println("open connection:", err)
 		return
 	}
+	name = sess.hello.Name
 	conn.SetDeadline(time.Time{})
-	log.Println("accept:", name, conn.RemoteAddr(), "->", conn.LocalAddr(), "OK")
-
-	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		if names, _ := net.LookupAddr(addr.IP.String()); len(names) > 0 {
-			host = names[0]
-			// remove trailing . if any
-			if len(host) > 0 && host[len(host)-1] == '.' {
-				host = host[:len(host)-1]
-			}
-		}
+	select {
+	case <-stop:
+		// the read deadline set when stopping during the handshake is cleared
+		conn.SetReadDeadline(time.Now())
+	default:
 	}
+	log.Println("accept:", name, conn.RemoteAddr(), "->", conn.LocalAddr(), "protocol", sess.proto, sess.hello.Version, "OK")
+
+	enr := newEnricher(conn, name, enrichFields)
 	if lh, err := os.Hostname(); err == nil {
 		localhost = lh
 	}
 
-	utime := time.Now().UnixNano() / 1000
-	msgs <- []byte(fmt.Sprintf(`J{"asctime":"%s","levelname":"INFO","componentname":"logCollector","customname":"","message":"accept connection","spacer":" with ","varmessage":"%s","host":"%s","utime":%d}`, time.Now().UTC().Format("2006-01-02 15:04:05"), name, localhost, utime))
-	trailer := fmt.Sprintf(",\"host\":\"%s\"}", host)
+	msgs.push(msgItem{data: connectionEvent("accept connection", name, localhost)})
+
+	if rateLimits != nil {
+		bucket = rateLimits.acquire(rateLimits.clientKey(conn, name))
+	}
+
+	if *e2eAckFlag {
+		win = newAckWindow(conn, acks)
+	}
 
-	// asynchronous acknowledgment reply
+	// asynchronous acknowledgment reply. The acks channel is drained until it
+	// is closed, even after a write error, so that senders never block on it.
+	acksDone = make(chan struct{})
 	go func() {
+		defer close(acksDone)
 		buf := make([]byte, 0, 10000)
 		ticker := time.NewTicker(flushPeriod)
+		defer ticker.Stop()
+		broken := false
 		for {
 			select {
 			case ack, ok := <-acks:
 				if !ok {
-					return // terminate when the acks channel is closed
+					// send pending acknowledgments and terminate when the acks channel is closed
+					if len(buf) > 0 && !broken {
+						conn.SetWriteDeadline(time.Now().Add(timeOutDelay))
+						if _, err := conn.Write(buf); err != nil {
+							log.Println("send acknowledgment error:", err)
+						}
+					}
+					return
+				}
+				if !broken {
+					buf = append(buf, ack)
 				}
-				buf = append(buf, ack)
 			case <-ticker.C:
 				if len(buf) > 0 {
+					conn.SetWriteDeadline(time.Now().Add(timeOutDelay))
 					n, err := conn.Write(buf)
+					if err == nil && n != len(buf) {
+						err = errors.Errorf("short write: expected len %d, got %d", len(buf), n)
+					}
 					if err != nil {
 						log.Println("send acknowledgment error:", err)
 						conn.Close()
-						return
-					}
-					if n != len(buf) {
-						log.Printf("send acknowledgment error: short write: expected len %d, got %d", len(buf), n)
-						conn.Close()
-						return
+						broken = true
 					}
 					buf = buf[:0]
 				}
@@ -109,8 +131,36 @@ func receiveMsg(conn net.Conn, msgs chan []byte, printMsg bool, stats *Stats) {
 		}
 	}()
 
+	// decompress the message stream if negotiated in the handshake
+	var (
+		r        io.Reader = conn
+		wire     *countReader
+		lastWire uint64
+	)
+	if sess.welcome.Compression != "" {
+		wire = &countReader{r: conn}
+		if r, err = newDecompressor(sess.welcome.Compression, wire); err != nil {
+			log.Println("message: recv compressed stream:", err)
+			return
+		}
+	}
+
+	// reject sends a negative acknowledgment for a message that can't be accepted
+	reject := func(err error) {
+		if rejects%1000 == 0 {
+			log.Printf("message: reject message from %s: %v (%d rejected)", name, err, rejects+1)
+		}
+		rejects++
+		stats.Reject()
+		if win != nil {
+			win.nak()
+		} else {
+			acks <- nakCode
+		}
+	}
+
 	for {
-		err = readAll(conn, hdr[:])
+		err = readAll(r, hdr[:])
 		if err != nil {
 			if err == io.EOF {
 				err = fmt.Errorf("connection closed by client %s", name)
@@ -123,23 +173,105 @@ func receiveMsg(conn net.Conn, msgs chan []byte, printMsg bool, stats *Stats) {
 			return
 		}
 		dataLen := int(binary.LittleEndian.Uint32(hdr[4:]))
-		buf := make([]byte, dataLen, dataLen+len(trailer)-1)
-		err = readAll(conn, buf)
+		if dataLen > lc.maxMsg {
+			// skip the message data so that the connection remains usable
+			if _, err = io.CopyN(ioutil.Discard, r, int64(dataLen)); err != nil {
+				log.Println("message: skip data:", err)
+				return
+			}
+			reject(errors.Wrapf(ErrFrameTooLarge, "message size %d exceeds limit %d", dataLen, lc.maxMsg))
+			continue
+		}
+		buf := make([]byte, dataLen)
+		err = readAll(r, buf)
 		if err != nil {
 			log.Println("message: recv data:", err)
 			return
 		}
+		if wire != nil {
+			n := atomic.LoadUint64(&wire.n)
+			stats.CompressedIn(8+dataLen, int(n-lastWire))
+			lastWire = n
+		}
 
-		// add host field to message if not yet present
-		if strings.Index(string(buf), "\"host\":\"") == -1 {
-			buf = append(buf[:len(buf)-1], trailer...)
+		if bucket != nil {
+			// slow down the client by delaying the acknowledgments
+			if delay := bucket.wait(1, stop); delay > 0 {
+				if throttles%1000 == 0 {
+					log.Printf("message: rate limit of %s (%s) exceeded, delay %v (%d delayed)", name, bucket.key, delay, throttles+1)
+				}
+				throttles++
+			}
+		}
+
+		if err = checkMsg(buf); err != nil {
+			reject(err)
+			continue
+		}
+
+		if buf, err = enr.enrich(buf); err != nil {
+			reject(err)
+			continue
 		}
 
 		if printMsg {
 			log.Println("msg:", string(buf))
 		}
-		msgs <- buf
-		acks <- ackCode
+		if win != nil {
+			msgs.push(msgItem{data: buf, ack: win.add()})
+		} else {
+			msgs.push(msgItem{data: buf})
+			acks <- ackCode
+		}
 		stats.Update(len(buf))
 	}
 }
+
+// refuseMsg replies to the open connection handshake of the client connected
+// to conn with the reason of the refusal, and closes conn.
+func refuseMsg(conn net.Conn, lc *listenerConfig, reason error) {
+	conn.SetDeadline(time.Now().Add(timeOutDelay))
+	acceptHandshake(conn, lc, reason)
+	conn.Close()
+}
+
+// connectionEvent returns the json encoded message emitted when the connection
+// with the client name is accepted or closed by the logCollector on host.
+func connectionEvent(message, name, host string) []byte {
+	now := time.Now()
+	buf := make([]byte, 0, 256)
+	buf = append(buf, `J{"asctime":`...)
+	buf = appendJSONString(buf, now.UTC().Format("2006-01-02 15:04:05"))
+	buf = append(buf, `,"levelname":"INFO","componentname":"logCollector","customname":"","message":`...)
+	buf = appendJSONString(buf, message)
+	buf = append(buf, `,"spacer":" with ","varmessage":`...)
+	buf = appendJSONString(buf, name)
+	buf = append(buf, `,"host":`...)
+	buf = appendJSONString(buf, host)
+	buf = append(buf, `,"utime":`...)
+	buf = strconv.AppendInt(buf, now.UnixNano()/1000, 10)
+	return append(buf, '}')
+}
+
+// rejectRegexp matches the received messages to reject, if not nil.
+var rejectRegexp *regexp.Regexp
+
+// checkMsg returns an error when the received message msg can't be accepted.
+func checkMsg(msg []byte) error {
+	if len(msg) == 0 {
+		return errors.New("empty message")
+	}
+	switch msg[0] {
+	case 'J':
+		if !json.Valid(msg[1:]) {
+			return errors.New("invalid json encoding")
+		}
+	case 'B':
+	default:
+		return errors.Wrapf(ErrUnknownEncoding, "encoding 0x%02x", msg[0])
+	}
+	if rejectRegexp != nil && rejectRegexp.Match(msg) {
+		return errors.New("rejected by filter")
+	}
+	return nil
+}
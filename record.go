@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// binaryFieldNames are the keys of the fixed fields of a binary encoded message.
+var binaryFieldNames = []string{"asctime", "levelname", "name", "componentname", "message"}
+
+// record is a message parsed into its ordered top level fields.
+type record struct {
+	enc     byte     // 'J' or 'B'
+	keys    []string // field keys
+	values  [][]byte // json encoded values for 'J', raw strings for 'B'
+	changed bool     // a field was added
+}
+
+// parseRecord parses the json or binary encoded message msg. A binary
+// message holds the length prefixed fixed fields, followed by the length
+// prefixed key and value of each additional field.
+func parseRecord(msg []byte) (*record, error) {
+	if len(msg) == 0 {
+		return nil, ErrUnknownEncoding
+	}
+	r := &record{enc: msg[0]}
+	switch msg[0] {
+	case 'J':
+		dec := json.NewDecoder(bytes.NewReader(msg[1:]))
+		if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+			return nil, errors.New("json message is not an object")
+		}
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return nil, errors.Wrap(err, "decode json key")
+			}
+			var v json.RawMessage
+			if err = dec.Decode(&v); err != nil {
+				return nil, errors.Wrap(err, "decode json value")
+			}
+			r.keys = append(r.keys, t.(string))
+			r.values = append(r.values, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, errors.Wrap(err, "decode json")
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("trailing data after json object")
+		}
+	case 'B':
+		strs, err := splitBinary(msg[1:])
+		if err != nil {
+			return nil, err
+		}
+		r.keys = append(r.keys, binaryFieldNames...)
+		r.values = append(r.values, strs[:len(binaryFieldNames)]...)
+		for i := len(binaryFieldNames); i < len(strs); i += 2 {
+			r.keys = append(r.keys, string(strs[i]))
+			r.values = append(r.values, strs[i+1])
+		}
+	default:
+		return nil, errors.Wrapf(ErrUnknownEncoding, "encoding 0x%02x", msg[0])
+	}
+	return r, nil
+}
+
+// splitBinary returns the length prefixed strings of the binary encoded
+// message data, without the leading 'B'. It returns an error if data is
+// truncated or doesn't hold the fixed fields followed by key value pairs.
+func splitBinary(data []byte) ([][]byte, error) {
+	strs := make([][]byte, 0, len(binaryFieldNames))
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.Wrap(errBinaryTruncated, "binary decode")
+		}
+		l := binary.LittleEndian.Uint32(data[:4])
+		data = data[4:]
+		if uint64(l) > uint64(len(data)) {
+			return nil, errors.Wrap(errBinaryTruncated, "binary decode")
+		}
+		strs = append(strs, data[:l:l])
+		data = data[l:]
+	}
+	if len(strs) < len(binaryFieldNames) || (len(strs)-len(binaryFieldNames))%2 != 0 {
+		return nil, errors.Errorf("binary decode: unexpected number of fields %d", len(strs))
+	}
+	return strs, nil
+}
+
+// errBinaryTruncated is returned when a binary encoded message is truncated.
+var errBinaryTruncated = errors.New("truncated message")
+
+// has returns true if the record has a field with key.
+func (r *record) has(key string) bool {
+	for _, k := range r.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends the string field key with value if not yet present.
+func (r *record) add(key, value string) {
+	if r.has(key) {
+		return
+	}
+	r.keys = append(r.keys, key)
+	if r.enc == 'J' {
+		r.values = append(r.values, appendJSONString(nil, value))
+	} else {
+		r.values = append(r.values, []byte(value))
+	}
+	r.changed = true
+}
+
+// encode returns the record encoded with its encoding.
+func (r *record) encode() []byte {
+	n := 2
+	for i := range r.keys {
+		n += len(r.keys[i]) + len(r.values[i]) + 8
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, r.enc)
+	if r.enc == 'B' {
+		var b [4]byte
+		for i := range r.keys {
+			if i >= len(binaryFieldNames) {
+				binary.LittleEndian.PutUint32(b[:], uint32(len(r.keys[i])))
+				buf = append(buf, b[:]...)
+				buf = append(buf, r.keys[i]...)
+			}
+			binary.LittleEndian.PutUint32(b[:], uint32(len(r.values[i])))
+			buf = append(buf, b[:]...)
+			buf = append(buf, r.values[i]...)
+		}
+		return buf
+	}
+	buf = append(buf, '{')
+	for i := range r.keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, r.keys[i])
+		buf = append(buf, ':')
+		buf = append(buf, r.values[i]...)
+	}
+	return append(buf, '}')
+}
+
+// value returns the value of the field key as a string, and false if the
+// record has no such field. Json values that are not strings are returned
+// json encoded, and null as the empty string.
+func (r *record) value(key string) (string, bool) {
+	for i, k := range r.keys {
+		if k == key {
+			return r.stringValue(i), true
+		}
+	}
+	return "", false
+}
+
+// stringValue returns the value of the field i as a string.
+func (r *record) stringValue(i int) string {
+	if r.enc == 'B' {
+		return string(r.values[i])
+	}
+	return jsonString(r.values[i])
+}
+
+// jsonString returns the json encoded value v as a string. Values that are not
+// strings are returned json encoded, and null as the empty string.
+func jsonString(v []byte) string {
+	switch {
+	case len(v) > 0 && v[0] == '"':
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			return s
+		}
+	case string(v) == "null":
+		return ""
+	}
+	return string(v)
+}
+
+// convert converts the record to the encoding enc. A binary record starts
+// with the fixed fields, which are set to the empty string when missing.
+func (r *record) convert(enc byte) {
+	if r.enc == enc {
+		return
+	}
+	keys := make([]string, 0, len(r.keys)+len(binaryFieldNames))
+	values := make([][]byte, 0, cap(keys))
+	if enc == 'B' {
+		for _, k := range binaryFieldNames {
+			v, _ := r.value(k)
+			keys = append(keys, k)
+			values = append(values, []byte(v))
+		}
+	}
+	for i, k := range r.keys {
+		if enc == 'B' && chooseOption([]string{k}, binaryFieldNames) != "" {
+			continue
+		}
+		v := r.stringValue(i)
+		keys = append(keys, k)
+		if enc == 'J' {
+			values = append(values, appendJSONString(nil, v))
+		} else {
+			values = append(values, []byte(v))
+		}
+	}
+	r.enc, r.keys, r.values, r.changed = enc, keys, values, true
+}
+
+// errNotString is returned when a json value that is not a string is binary
+// encoded, as the values of a binary message are strings.
+var errNotString = errors.New("value is not a json string")
+
+// transcode returns the message msg encoded with enc. A json message with
+// values that are not strings, which would become strings, can't be binary
+// encoded.
+func transcode(msg []byte, enc byte) ([]byte, error) {
+	if len(msg) > 0 && msg[0] == enc {
+		return msg, nil
+	}
+	r, err := parseRecord(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "transcode")
+	}
+	if enc == 'B' {
+		for i, v := range r.values {
+			if len(v) == 0 || v[0] != '"' {
+				return nil, errors.Wrapf(errNotString, "transcode field %s", r.keys[i])
+			}
+		}
+	}
+	r.convert(enc)
+	return r.encode(), nil
+}
+
+// appendJSONLine appends the message msg to buf as a one line json record.
+func appendJSONLine(buf, msg []byte) ([]byte, error) {
+	msg, err := transcode(msg, 'J')
+	if err != nil {
+		return buf, err
+	}
+	start := len(buf)
+	buf = append(buf, msg[1:]...)
+	// newlines may only be whitespace between json tokens
+	for i := start; i < len(buf); i++ {
+		if buf[i] == '\n' || buf[i] == '\r' {
+			buf[i] = ' '
+		}
+	}
+	return append(buf, '\n'), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTranscode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		err  error
+	}{
+		{
+			name: "fixed fields",
+			msg:  `J{"asctime":"2026-10-17 12:00:00","levelname":"INFO","name":"system","componentname":"component","message":"text"}`,
+		},
+		{
+			name: "string extra fields",
+			msg:  `J{"asctime":"2026-10-17 12:00:00","levelname":"INFO","name":"system","componentname":"component","message":"text","host":"host1","quote":"a\"b"}`,
+		},
+		{
+			name: "number",
+			msg:  `J{"asctime":"2026-10-17 12:00:00","levelname":"INFO","name":"system","componentname":"component","message":"text","utime":123}`,
+			err:  errNotString,
+		},
+		{name: "bool", msg: `J{"message":"text","ok":true}`, err: errNotString},
+		{name: "null", msg: `J{"message":"text","host":null}`, err: errNotString},
+		{name: "object", msg: `J{"message":"text","extra":{"a":"b"}}`, err: errNotString},
+		{name: "array", msg: `J{"message":"text","tags":["a"]}`, err: errNotString},
+		{name: "fixed field", msg: `J{"message":1}`, err: errNotString},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bin, err := transcode([]byte(test.msg), 'B')
+			if test.err != nil {
+				if errors.Cause(err) != test.err {
+					t.Fatalf("expected error %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = checkMsg(bin); err != nil || bin[0] != 'B' {
+				t.Fatalf("expected binary message, got %q: %v", bin, err)
+			}
+			msg, err := transcode(bin, 'J')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != test.msg {
+				t.Errorf("expected %s, got %s", test.msg, msg)
+			}
+		})
+	}
+}
+
+func TestBinaryEncodeNotString(t *testing.T) {
+	m := &Msg{Message: "text"}
+	m.Extra.Set("utime", []byte("123"))
+	if _, err := m.BinaryEncode(nil); errors.Cause(err) != errNotString {
+		t.Errorf("expected error %v, got %v", errNotString, err)
+	}
+}
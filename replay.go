@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// replayFilter selects the replayed messages.
+type replayFilter struct {
+	from      string // minimum asctime, no limit if empty
+	to        string // maximum asctime (excluded), no limit if empty
+	system    string // system name, any if empty
+	component string // component name, any if empty
+}
+
+// match returns true if the message msg is selected by the filter.
+func (f *replayFilter) match(msg []byte) (bool, error) {
+	if f.from == "" && f.to == "" && f.system == "" && f.component == "" {
+		return true, nil
+	}
+	r, err := parseRecord(msg)
+	if err != nil {
+		return false, err
+	}
+	// asctime values have the format "2006-01-02 15:04:05" and are compared as strings
+	if asctime, _ := r.value("asctime"); (f.from != "" && asctime < f.from) || (f.to != "" && asctime >= f.to) {
+		return false, nil
+	}
+	if system, _ := r.value("name"); f.system != "" && system != f.system {
+		return false, nil
+	}
+	if component, _ := r.value("componentname"); f.component != "" && component != f.component {
+		return false, nil
+	}
+	return true, nil
+}
+
+// replayStats are the progress counters of the replay.
+type replayStats struct {
+	files    int          // number of files replayed
+	sent     uint64       // number of messages sent
+	filtered uint64       // number of messages skipped by the filter
+	invalid  uint64       // number of invalid messages skipped
+	in       *countReader // reader of the current file
+	size     int64        // size of the current file
+}
+
+// runAsReplay sends the messages archived in the files matching the comma
+// separated glob patterns to the logCollector at addresses. The files contain
+// json lines or DLCM frames, and may be gzip or zstd compressed.
+func runAsReplay(patterns string, filter *replayFilter, rate float64, addresses []string, keyFile, crtFile string, certPool *x509.CertPool, stats *Stats) {
+	log.SetPrefix("replay  ")
+	var files []string
+	for _, pattern := range splitAddresses(patterns) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Fatalln("replay:", err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		log.Fatalln("replay: no file matching", patterns)
+	}
+	log.Println("target:", *addressFlag, "files:", len(files))
+
+	q := newOutputQueue("fwd", 1000)
+	done := make(chan struct{})
+	go func() {
+		runOutput(newFwdState(addresses, keyFile, crtFile, certPool), q, maxMsgs, stats)
+		close(done)
+	}()
+
+	var (
+		ps       replayStats
+		shutdown = shutdownSignal()
+		start    = time.Now()
+		ticker   = time.NewTicker(time.Duration(*statPeriodFlag) * time.Second)
+		progress = func(name string) {
+			pct := 100.0
+			if ps.in != nil && ps.size > 0 {
+				pct = 100 * float64(atomic.LoadUint64(&ps.in.n)) / float64(ps.size)
+			}
+			log.Printf("progress: file %d/%d %s %.1f%%, sent %d, filtered %d, invalid %d",
+				ps.files, len(files), name, pct, ps.sent, ps.filtered, ps.invalid)
+		}
+	)
+	defer ticker.Stop()
+	stopped := false
+	for _, name := range files {
+		ps.files++
+		err := replayFile(name, &ps, func(msg []byte) bool {
+			if ok, err := filter.match(msg); err != nil {
+				ps.invalid++
+				return true
+			} else if !ok {
+				ps.filtered++
+				return true
+			}
+			if rate > 0 {
+				// wait until the time of the message at the given rate
+				if wait := time.Duration(float64(ps.sent)/rate*float64(time.Second)) - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			for {
+				select {
+				case q.msgs <- msgItem{data: msg}:
+					stats.Update(len(msg))
+					ps.sent++
+					return true
+				case <-ticker.C:
+					progress(name)
+				case <-shutdown:
+					stopped = true
+					return false
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("replay %s: %v", name, err)
+		}
+		progress(name)
+		if stopped {
+			break
+		}
+	}
+	if !stopped {
+		log.Printf("replay done: sent %d messages", ps.sent)
+	}
+
+	// wait until the queued messages are acknowledged
+	close(q.msgs)
+	select {
+	case <-done:
+		log.Println("shutdown: done")
+	case <-time.After(time.Duration(*shutdownFlag) * time.Second):
+		log.Println("shutdown: drain deadline exceeded, pending messages may be lost")
+	}
+}
+
+// replayFile calls send with each message of the archive file name until it
+// returns false.
+func replayFile(name string, ps *replayStats, send func(msg []byte) bool) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	ps.size = info.Size()
+	ps.in = &countReader{r: file}
+	var r io.Reader = ps.in
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(name, ".zst"):
+		cmd := exec.Command("zstd", "-dc")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err = cmd.Start(); err != nil {
+			return errors.Wrap(err, "zstd")
+		}
+		defer cmd.Wait()
+		defer out.Close()
+		r = out
+	}
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	hdr, err := br.Peek(4)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(hdr) == "DLCM" {
+		var hdr [8]byte
+		for {
+			if _, err = io.ReadFull(br, hdr[:]); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errors.Wrap(err, "read header")
+			}
+			if string(hdr[:4]) != "DLCM" {
+				return errors.Errorf("expected 'DLCM', got '%s'", hdr[:4])
+			}
+			msg := make([]byte, binary.LittleEndian.Uint32(hdr[4:]))
+			if _, err = io.ReadFull(br, msg); err != nil {
+				return errors.Wrap(err, "read message")
+			}
+			if !send(msg) {
+				return nil
+			}
+		}
+	}
+
+	// json lines
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			msg := make([]byte, 1+len(line))
+			msg[0] = 'J'
+			copy(msg[1:], line)
+			if !send(msg) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
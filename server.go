@@ -1,11 +1,13 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/tls"
 	"crypto/x509"
 	"log"
 	"net"
+	"os"
+	"regexp"
+	"sync"
+	"time"
 )
 
 type msgInfo struct {
@@ -16,52 +18,220 @@ type msgInfo struct {
 func runAsServer(addresses []string, keyFile, crtFile string, certPool *x509.CertPool, printMsg bool, stats *Stats) {
 	log.SetPrefix("server  ")
 
-	if len(addresses) != 1 {
-		log.Fatalln("invalid number of addresses in", *addressFlag, "got", len(addresses))
+	if len(addresses) == 0 {
+		log.Fatalln("no listen address in", *addressFlag)
 	}
 
-	msgs := make(chan []byte, *dbBufLenFlag*10)
-	defer close(msgs)
+	var err error
+	if *rejectFlag != "" {
+		if rejectRegexp, err = regexp.Compile(*rejectFlag); err != nil {
+			log.Fatalln("invalid reject regular expression:", err)
+		}
+	}
+	if enrichFields, err = parseEnrichFields(*enrichFlag); err != nil {
+		log.Fatalln("invalid enrich flag:", err)
+	}
+	if rateLimits, err = parseRateLimits(*clientRateFlag, *rateKeyFlag); err != nil {
+		log.Fatalln("invalid client rate flag:", err)
+	}
 
+	// the received messages wait in the fair queue, where the clients are
+	// served in turn, rather than in the msgs channel
+	msgs := make(chan msgItem)
+
+	urls := []string(outputsFlag)
 	if *mysqlFlag {
-		go mysqlOutput(msgs)
-	} else if *logstashFlag != "" {
-		go logstashOutput(msgs, *logstashFlag)
-	} else if *fwdAddrFlag != "" {
-		go fwdOutput(msgs, splitAddresses(*fwdAddrFlag), *keyFileFlag, *crtFileFlag, certPool)
-	} else {
-		go noOutput(msgs)
+		urls = append(urls, "mysql://")
+	}
+	if *logstashFlag != "" {
+		urls = append(urls, "logstash://"+*logstashFlag)
+	}
+	if *fwdAddrFlag != "" {
+		urls = append(urls, "dlc://"+*fwdAddrFlag)
+	}
+	if len(urls) == 0 {
+		urls = append(urls, "null://")
 	}
-
 	var (
-		listener net.Listener
-		err      error
+		outputs   []*outputQueue
+		outputsWg sync.WaitGroup
 	)
-	// listen for a TLS connection
-	var serverCert tls.Certificate
-	serverCert, err = tls.LoadX509KeyPair(crtFile, keyFile)
+	for _, rawURL := range urls {
+		o, err := NewOutput(rawURL)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		policy, err := outputOverflow(rawURL)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		q := newOutputQueue(outputName(rawURL), *queueLenFlag)
+		q.drop = policy == overflowDrop
+		stats.AddOutput(q)
+		outputsWg.Add(1)
+		go func(o Output, q *outputQueue) {
+			defer outputsWg.Done()
+			runOutput(o, q, *dbBufLenFlag, stats)
+		}(o, q)
+		outputs = append(outputs, q)
+	}
+	go fanOut(msgs, outputs)
+	fq := newFairQueue(msgs)
+	go fq.run()
+
+	// listen for TLS or plaintext connections on each address
+	config, err := newServerTLSConfig(keyFile, crtFile, certPool)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	config := tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    certPool,
+	var (
+		dlcConfigs   []*listenerConfig
+		dlcListeners []net.Listener
+	)
+	for _, address := range addresses {
+		lc, err := parseListener(address, config, keyFile, crtFile, *casFileFlag)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		listener, err := lc.listen()
+		if err != nil {
+			log.Fatalln("failed listen:", err)
+		}
+		if lc.tls == nil {
+			log.Println("listen:", lc.address, "plaintext")
+		} else {
+			log.Println("listen:", lc.address)
+		}
+		dlcConfigs = append(dlcConfigs, lc)
+		dlcListeners = append(dlcListeners, listener)
 	}
-	config.Rand = rand.Reader
-	listener, err = tls.Listen("tcp", addresses[0], &config)
+
+	var conns connSet
+	listeners, err := startSyslog(*syslogFlag, config, fq, &conns, printMsg, stats)
 	if err != nil {
-		log.Fatalln("failed listen:", err)
+		log.Fatalln(err)
+	}
+	if *httpFlag != "" {
+		srv, err := startHTTP(*httpFlag, config, fq, conns.stopping(), printMsg, stats)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		listeners = append(listeners, srv)
 	}
+	shutdown := shutdownSignal()
+	closed := make(chan struct{}) // closed when the listeners are closed
+	go func() {
+		<-shutdown
+		log.Println("shutdown: stop accepting connections")
+		conns.stop()
+		for _, l := range dlcListeners {
+			l.Close()
+		}
+		// the HTTP server waits for the requests being processed
+		for _, l := range listeners {
+			l.Close()
+		}
+		close(closed)
+	}()
 
-	log.Println("listen:", *addressFlag)
+	var acceptWg sync.WaitGroup
+	for i, listener := range dlcListeners {
+		lc := dlcConfigs[i]
+		a := newAcceptor(listener, &conns, lc.maxConns, stats, log.New(os.Stdout, "server  ", log.Flags()),
+			func(conn net.Conn) { receiveMsg(conn, lc, fq, conns.stopping(), printMsg, stats) },
+			func(conn net.Conn) { refuseMsg(conn, lc, errTooManyConns) })
+		acceptWg.Add(1)
+		go func() {
+			defer acceptWg.Done()
+			a.run()
+		}()
+	}
+	acceptWg.Wait()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatalln("accept error:", err)
+	// drain received messages into the outputs
+	drained := make(chan struct{})
+	go func() {
+		conns.wait()
+		<-closed
+		fq.close() // closes msgs once the queued messages are sent
+		outputsWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Println("shutdown: done")
+	case <-time.After(time.Duration(*shutdownFlag) * time.Second):
+		log.Println("shutdown: drain deadline exceeded, pending messages may be lost")
+	}
+}
+
+// connSet tracks the open connections to stop them on shutdown.
+type connSet struct {
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+	done  bool
+	stopC chan struct{} // closed by stop
+	wg    sync.WaitGroup
+}
+
+// add adds conn to the set. Reading from conn is stopped if the set is stopped.
+func (cs *connSet) add(conn net.Conn) {
+	cs.mtx.Lock()
+	if cs.conns == nil {
+		cs.conns = make(map[net.Conn]struct{})
+	}
+	cs.conns[conn] = struct{}{}
+	cs.wg.Add(1)
+	if cs.done {
+		conn.SetReadDeadline(time.Now())
+	}
+	cs.mtx.Unlock()
+}
+
+// remove removes conn from the set.
+func (cs *connSet) remove(conn net.Conn) {
+	cs.mtx.Lock()
+	delete(cs.conns, conn)
+	cs.wg.Done()
+	cs.mtx.Unlock()
+}
+
+// stop unblocks the pending reads on all connections so that the receiving
+// goroutines send their pending acknowledgments and terminate.
+func (cs *connSet) stop() {
+	cs.mtx.Lock()
+	if !cs.done {
+		cs.done = true
+		if cs.stopC == nil {
+			cs.stopC = make(chan struct{})
 		}
-		go receiveMsg(conn, msgs, printMsg, stats)
+		close(cs.stopC)
+	}
+	for conn := range cs.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	cs.mtx.Unlock()
+}
+
+// stopping returns a channel closed when stop is called, to interrupt the
+// waits of the receiving goroutines.
+func (cs *connSet) stopping() <-chan struct{} {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if cs.stopC == nil {
+		cs.stopC = make(chan struct{})
 	}
+	return cs.stopC
+}
+
+// stopped returns true when stop has been called.
+func (cs *connSet) stopped() bool {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	return cs.done
+}
+
+// wait waits until all connections are removed.
+func (cs *connSet) wait() {
+	cs.wg.Wait()
 }
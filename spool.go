@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Spool overflow policies.
+const (
+	spoolBlock = "block" // send blocks until acknowledgments free space
+	spoolDrop  = "drop"  // new messages are dropped while the spool is full
+)
+
+const spoolSegSize = 4 << 20 // segment file size triggering rotation
+const spoolAckFile = "ack"
+
+// ErrSpoolFull is returned when appending a message would exceed the spool size limit.
+var ErrSpoolFull = errors.New("spool full")
+
+// spoolSeg is a segment file of the spool.
+type spoolSeg struct {
+	id   uint64
+	size int64
+}
+
+// spool is a persistent FIFO of messages stored in segment files. Messages are
+// stored with their DLCM header, as they are sent on the wire. The position of
+// the first unacknowledged message is stored in the ack file.
+type spool struct {
+	dir     string
+	maxSize int64
+	segs    []spoolSeg // segs[0] holds the first unacknowledged message
+	ackOff  int64      // offset of the first unacknowledged message in segs[0]
+	size    int64      // total size of unacknowledged messages
+	file    *os.File   // last segment, open for appending
+	w       *bufio.Writer
+}
+
+// openSpool opens or creates the spool in dir and returns the unacknowledged
+// messages it contains.
+func openSpool(dir string, maxSize int64) (*spool, [][]byte, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, nil, errors.Wrap(err, "open spool")
+	}
+	s := &spool{dir: dir, maxSize: maxSize}
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open spool")
+	}
+	ackID, ackOff := s.readAck()
+
+	var msgs [][]byte
+	for _, id := range ids {
+		if id < ackID {
+			os.Remove(s.segName(id))
+			continue
+		}
+		off := int64(0)
+		if id == ackID {
+			off = ackOff
+		}
+		segMsgs, size, err := s.readSegment(id, off)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "open spool")
+		}
+		if len(s.segs) == 0 {
+			s.ackOff = off
+		}
+		s.segs = append(s.segs, spoolSeg{id: id, size: size})
+		s.size += size - off
+		msgs = append(msgs, segMsgs...)
+	}
+	if len(s.segs) == 0 {
+		s.segs = append(s.segs, spoolSeg{id: ackID})
+	}
+	last := s.segs[len(s.segs)-1]
+	s.file, err = os.OpenFile(s.segName(last.id), os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open spool")
+	}
+	// drop a partially written message at the end of the last segment
+	if err = s.file.Truncate(last.size); err != nil {
+		s.file.Close()
+		return nil, nil, errors.Wrap(err, "open spool")
+	}
+	if _, err = s.file.Seek(last.size, io.SeekStart); err != nil {
+		s.file.Close()
+		return nil, nil, errors.Wrap(err, "open spool")
+	}
+	s.w = bufio.NewWriterSize(s.file, 64*1024)
+	return s, msgs, nil
+}
+
+// segName returns the file name of segment id.
+func (s *spool) segName(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d.seg", id))
+}
+
+// segmentIDs returns the sorted ids of the segment files in the spool directory.
+func (s *spool) segmentIDs() ([]uint64, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// readAck returns the position of the first unacknowledged message. A missing
+// or invalid ack file yields the start of the spool.
+func (s *spool) readAck() (uint64, int64) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolAckFile))
+	if err != nil || len(data) != 16 {
+		return 0, 0
+	}
+	return binary.LittleEndian.Uint64(data[:8]), int64(binary.LittleEndian.Uint64(data[8:]))
+}
+
+// writeAck stores the position of the first unacknowledged message.
+func (s *spool) writeAck() error {
+	var data [16]byte
+	binary.LittleEndian.PutUint64(data[:8], s.segs[0].id)
+	binary.LittleEndian.PutUint64(data[8:], uint64(s.ackOff))
+	tmpName := filepath.Join(s.dir, spoolAckFile+".tmp")
+	if err := ioutil.WriteFile(tmpName, data[:], 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(s.dir, spoolAckFile))
+}
+
+// readSegment returns the messages of segment id starting at offset off, and
+// the size of the segment up to the last complete message.
+func (s *spool) readSegment(id uint64, off int64) ([][]byte, int64, error) {
+	data, err := ioutil.ReadFile(s.segName(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	var msgs [][]byte
+	pos := int64(0)
+	for int64(len(data))-pos >= 8 {
+		if string(data[pos:pos+4]) != "DLCM" {
+			return nil, 0, errors.Errorf("segment %d: invalid message header at offset %d", id, pos)
+		}
+		msgLen := int64(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if int64(len(data))-pos-8 < msgLen {
+			break
+		}
+		if pos >= off {
+			msgs = append(msgs, data[pos+8:pos+8+msgLen])
+		}
+		pos += 8 + msgLen
+	}
+	return msgs, pos, nil
+}
+
+// append adds msg at the end of the spool. It returns ErrSpoolFull if msg
+// doesn't fit in the spool size limit.
+func (s *spool) append(msg []byte) error {
+	if s.full(len(msg)) {
+		return ErrSpoolFull
+	}
+	msgSize := int64(8 + len(msg))
+	if s.segs[len(s.segs)-1].size >= spoolSegSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	var hdr = [8]byte{'D', 'L', 'C', 'M', 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(msg)))
+	if _, err := s.w.Write(hdr[:]); err != nil {
+		return errors.Wrap(err, "spool append")
+	}
+	if _, err := s.w.Write(msg); err != nil {
+		return errors.Wrap(err, "spool append")
+	}
+	s.segs[len(s.segs)-1].size += msgSize
+	s.size += msgSize
+	return nil
+}
+
+// rotate closes the last segment and starts a new one.
+func (s *spool) rotate() error {
+	if err := s.close(); err != nil {
+		return errors.Wrap(err, "spool rotate")
+	}
+	id := s.segs[len(s.segs)-1].id + 1
+	file, err := os.OpenFile(s.segName(id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return errors.Wrap(err, "spool rotate")
+	}
+	s.file = file
+	s.w.Reset(file)
+	s.segs = append(s.segs, spoolSeg{id: id})
+	return nil
+}
+
+// ack removes size bytes of messages from the front of the spool and deletes
+// the segments that are fully acknowledged.
+func (s *spool) ack(size int64) error {
+	s.ackOff += size
+	s.size -= size
+	for len(s.segs) > 1 && s.ackOff >= s.segs[0].size {
+		s.ackOff -= s.segs[0].size
+		if err := os.Remove(s.segName(s.segs[0].id)); err != nil {
+			return errors.Wrap(err, "spool ack")
+		}
+		s.segs = s.segs[1:]
+	}
+	return errors.Wrap(s.writeAck(), "spool ack")
+}
+
+// full returns true when a message of length msgLen can't be appended. A
+// message is always accepted in an empty spool.
+func (s *spool) full(msgLen int) bool {
+	return s.maxSize > 0 && s.size > 0 && s.size+int64(8+msgLen) > s.maxSize
+}
+
+// flush writes buffered messages to the segment file.
+func (s *spool) flush() error {
+	return errors.Wrap(s.w.Flush(), "spool flush")
+}
+
+// close flushes and syncs the last segment and closes it.
+func (s *spool) close() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
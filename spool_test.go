@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendSpool appends msgs to s, and returns the spooled size of the messages.
+func appendSpool(t *testing.T, s *spool, msgs ...string) int64 {
+	var size int64
+	for _, msg := range msgs {
+		if err := s.append([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		size += int64(8 + len(msg))
+	}
+	return size
+}
+
+// reopenSpool closes s and opens the spool in its directory again, checking
+// it holds the messages want.
+func reopenSpool(t *testing.T, s *spool, want ...string) *spool {
+	dir, maxSize := s.dir, s.maxSize
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	s, msgs, err := openSpool(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		got = append(got, string(msg))
+	}
+	if want == nil {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %d messages %.40q, got %d %.40q", len(want), want, len(got), got)
+	}
+	return s
+}
+
+func TestSpoolPartialAppend(t *testing.T) {
+	dir := t.TempDir()
+	s, msgs, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("expected an empty spool, got %d messages", len(msgs))
+	}
+	appendSpool(t, s, "Jfirst", "Jsecond")
+	if err = s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while appending leaves a partial message at the end of the segment
+	seg := s.segName(0)
+	for _, partial := range []string{"DL", "DLCM\x10\x00\x00", "DLCM\x10\x00\x00\x00Jpar"} {
+		f, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.WriteString(partial); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if s, _, err = openSpool(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+		s = reopenSpool(t, s, "Jfirst", "Jsecond")
+	}
+
+	// the partial message is overwritten by the next one
+	appendSpool(t, s, "Jthird")
+	s = reopenSpool(t, s, "Jfirst", "Jsecond", "Jthird")
+	s.close()
+	data, err := os.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "DLCM\x06\x00\x00\x00JfirstDLCM\x07\x00\x00\x00JsecondDLCM\x06\x00\x00\x00Jthird"; string(data) != want {
+		t.Errorf("expected segment %q, got %q", want, data)
+	}
+
+	// a segment that is not made of messages can't be replayed
+	if err = os.WriteFile(seg, []byte("garbage!garbage!"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = openSpool(dir, 0); err == nil || !strings.Contains(err.Error(), "invalid message header") {
+		t.Errorf("expected invalid message header error, got %v", err)
+	}
+}
+
+func TestSpoolAckRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fifth message of 1 MB starts a new segment
+	var msgs []string
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, "J"+strings.Repeat(string(rune('a'+i)), 1<<20))
+	}
+	msgSize := appendSpool(t, s, msgs...) / 5
+	if len(s.segs) != 2 {
+		t.Fatalf("expected 2 segments, got %d", len(s.segs))
+	}
+	if err = s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the acknowledged messages are not replayed
+	if err = s.ack(2 * msgSize); err != nil {
+		t.Fatal(err)
+	}
+	s = reopenSpool(t, s, msgs[2:]...)
+	if _, err = os.Stat(s.segName(0)); err != nil {
+		t.Errorf("expected the first segment kept, got %v", err)
+	}
+
+	// the acknowledgment of the end of the first segment deletes it
+	if err = s.ack(2 * msgSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(s.segName(0)); !os.IsNotExist(err) {
+		t.Errorf("expected the first segment deleted, got %v", err)
+	}
+	s = reopenSpool(t, s, msgs[4:]...)
+	if len(s.segs) != 1 || s.segs[0].id != 1 || s.ackOff != 0 {
+		t.Errorf("expected the second segment from offset 0, got %v from %d", s.segs, s.ackOff)
+	}
+
+	// a segment older than the ack file position is deleted when reopening
+	if err = os.WriteFile(s.segName(0), []byte("DLCM\x01\x00\x00\x00J"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	appendSpool(t, s, "Jlast")
+	if err = s.ack(msgSize); err != nil {
+		t.Fatal(err)
+	}
+	s = reopenSpool(t, s, "Jlast")
+	if _, err = os.Stat(s.segName(0)); !os.IsNotExist(err) {
+		t.Errorf("expected the old segment deleted, got %v", err)
+	}
+
+	// an invalid ack file replays the whole spool
+	if err = os.WriteFile(filepath.Join(dir, spoolAckFile), []byte("bad"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	s = reopenSpool(t, s, msgs[4], "Jlast")
+	s.close()
+}
+
+func TestSpoolFull(t *testing.T) {
+	s, _, err := openSpool(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	// a message larger than the limit is accepted in an empty spool
+	big := "J" + strings.Repeat("x", 100)
+	size := appendSpool(t, s, big)
+	if !s.full(1) {
+		t.Error("expected the spool full")
+	}
+	if err = s.append([]byte("J")); err != ErrSpoolFull {
+		t.Errorf("expected %v, got %v", ErrSpoolFull, err)
+	}
+	if err = s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.ack(size); err != nil {
+		t.Fatal(err)
+	}
+	appendSpool(t, s, strings.Repeat("y", 28), strings.Repeat("z", 20))
+	if s.size != 64 || !s.full(0) {
+		t.Errorf("expected the spool full with 64 bytes, got %d bytes", s.size)
+	}
+}
+
+// newTestFwdState returns a fwdState with a spool in a new directory holding
+// at most maxSize bytes, with the overflow policy.
+func newTestFwdState(t *testing.T, maxSize int64, policy string) *fwdState {
+	f := newFwdState(nil, "", "", nil)
+	if err := f.openSpool(t.TempDir(), maxSize, policy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.spool.close() })
+	return f
+}
+
+func TestFwdStateSpoolPolicy(t *testing.T) {
+	f := newFwdState(nil, "", "", nil)
+	if err := f.openSpool(t.TempDir(), 0, "spill"); err == nil {
+		t.Error("expected an invalid policy error")
+	}
+
+	// the messages that don't fit in the spool are dropped
+	f = newTestFwdState(t, 32, spoolDrop)
+	for _, msg := range []string{"Jfirst", "Jsecond", "Jthird"} {
+		f.send([]byte(msg))
+	}
+	if f.len != 2 || f.dropped != 1 {
+		t.Errorf("expected 2 messages queued and 1 dropped, got %d and %d", f.len, f.dropped)
+	}
+
+	// or block until acknowledgments free room in the spool
+	f = newTestFwdState(t, 32, spoolBlock)
+	f.send([]byte("Jfirst"))
+	f.send([]byte("Jsecond"))
+	sent := make(chan struct{})
+	go func() {
+		f.send([]byte("Jthird"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expected send blocked by the full spool")
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.qMtx.Lock()
+	err := f.spool.flush()
+	f.qMtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.pop([]byte{ackCode})
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected send unblocked by the acknowledgment")
+	}
+	if f.len != 2 || f.dropped != 0 {
+		t.Errorf("expected 2 messages queued and none dropped, got %d and %d", f.len, f.dropped)
+	}
+	f.bMtx.Lock()
+	defer f.bMtx.Unlock()
+	if !bytes.HasSuffix(f.blobIn, []byte("DLCM\x06\x00\x00\x00Jthird")) {
+		t.Errorf("expected the third message sent, got %q", f.blobIn)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	l "log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sqlTableRegexp matches the valid table names.
+var sqlTableRegexp = regexp.MustCompile(`^[A-Za-z0-9_]{1,56}$`)
+
+// sqlDialect is the database specific part of a sqlOutput.
+type sqlDialect interface {
+	// open opens the database, and creates or migrates the message table.
+	open() (*sql.DB, error)
+	// insert inserts the rows returned by sqlRow in the message table of db.
+	insert(db *sql.DB, rows [][]interface{}) error
+}
+
+// sqlOutput writes the messages in a database table by batches of rows.
+type sqlOutput struct {
+	rejecter // rows rejected by the database
+	dialect  sqlDialect
+	db       *sql.DB
+	err      error
+	msgs     [][]byte
+	// called with the number of messages committed or lost
+	accepted func(n int, ok bool)
+}
+
+// newSQLOutput returns a new sqlOutput writing with dialect, logging with
+// prefix. Rows rejected by the database are moved to the dead letter file
+// deadLetterPath.
+func newSQLOutput(dialect sqlDialect, prefix, deadLetterPath string, bufLen int) *sqlOutput {
+	return &sqlOutput{
+		rejecter: newRejecter(deadLetterPath, l.New(os.Stdout, prefix, l.Flags()), "row"),
+		dialect:  dialect,
+		msgs:     make([][]byte, 0, bufLen),
+	}
+}
+
+// Error return the last error.
+func (db *sqlOutput) Error() error {
+	return db.err
+}
+
+// SetAccepted sets the function called when messages are committed or lost.
+func (db *sqlOutput) SetAccepted(accepted func(n int, ok bool)) {
+	db.accepted = accepted
+}
+
+// Start opens the database. A database that can't be opened is opened
+// again when messages are written.
+func (db *sqlOutput) Start() error {
+	db.tryOpenDatabase()
+	if db.err != nil {
+		db.log.Printf("database: %v", db.err)
+	}
+	return nil
+}
+
+// Write queues the messages, and writes them in the database when the buffer is full.
+func (db *sqlOutput) Write(msgs [][]byte) error {
+	for _, msg := range msgs {
+		if len(db.msgs) == cap(db.msgs) {
+			db.WriteMessages()
+		}
+		db.msgs = append(db.msgs, msg)
+	}
+	return nil
+}
+
+// Flush writes the queued messages in the database.
+func (db *sqlOutput) Flush() error {
+	db.WriteMessages()
+	return nil
+}
+
+// FlushPeriod returns the database flush period.
+func (db *sqlOutput) FlushPeriod() time.Duration {
+	return time.Duration(*dbFlushFlag) * time.Millisecond
+}
+
+// Close writes the queued messages in the database and closes it.
+func (db *sqlOutput) Close() error {
+	db.WriteMessages()
+	if err := db.deadLetter.close(); err != nil {
+		db.log.Println(err)
+	}
+	if db.db == nil {
+		return db.Error()
+	}
+	return db.db.Close()
+}
+
+// WriteMessages write the logging messages in the database. The write is
+// retried with an exponential backoff while the database is unreachable,
+// which blocks the output queue. The rows of a batch that fails dbr times
+// are written one by one, and those rejected are moved to the dead letter
+// file.
+func (db *sqlOutput) WriteMessages() {
+	if len(db.msgs) == 0 {
+		return
+	}
+	var (
+		rows    = make([][]interface{}, 0, len(db.msgs))
+		frames  = make([][]byte, 0, len(db.msgs))
+		dropped = db.dropped
+		counts  = db.counts()
+		now     = time.Now().UTC()
+	)
+	for _, msg := range db.msgs {
+		row, err := sqlRow(msg, now)
+		if err != nil {
+			db.reject(msg, err)
+			continue
+		}
+		rows = append(rows, row)
+		frames = append(frames, msg)
+	}
+	for attempt := 0; len(rows) > 0; attempt++ {
+		if db.db == nil || db.err != nil {
+			db.waitDatabase()
+		}
+		err := db.dialect.insert(db.db, rows)
+		if err == nil {
+			break
+		}
+		db.log.Printf("write %d rows: %v", len(rows), err)
+		if pingErr := db.db.Ping(); pingErr != nil {
+			// the database is unreachable, the attempt doesn't count
+			db.err = errors.Wrap(pingErr, "write to db")
+			db.db.Close()
+			db.db = nil
+			attempt--
+			db.retried += uint64(len(rows))
+			continue
+		}
+		if attempt >= *dbRetryFlag {
+			db.isolate(rows, frames)
+			break
+		}
+		db.retried += uint64(len(rows))
+		time.Sleep(backoffDelay(attempt))
+	}
+	if db.accepted != nil {
+		db.accepted(len(db.msgs), db.dropped == dropped)
+	}
+	db.logCounts(counts)
+	db.msgs = db.msgs[:0]
+}
+
+// isolate inserts the rows one by one, and moves the rows rejected by the
+// database to the dead letter file.
+func (db *sqlOutput) isolate(rows [][]interface{}, frames [][]byte) {
+	for i := range rows {
+		if err := db.dialect.insert(db.db, rows[i:i+1]); err != nil {
+			db.reject(frames[i], err)
+		}
+	}
+}
+
+// waitDatabase opens the database, and retries with an exponential backoff
+// until it succeeds.
+func (db *sqlOutput) waitDatabase() {
+	for attempt := 0; ; attempt++ {
+		db.tryOpenDatabase()
+		if db.err == nil {
+			return
+		}
+		delay := backoffDelay(attempt)
+		db.log.Printf("database: %v, retry in %v", db.err, delay)
+		time.Sleep(delay)
+	}
+}
+
+func (db *sqlOutput) tryOpenDatabase() {
+	db.db, db.err = db.dialect.open()
+	if db.err != nil {
+		db.db = nil
+		db.err = errors.Wrap(db.err, "open database")
+	}
+}
+
+// backoffDelay returns the delay before the retry following the failed attempt.
+func backoffDelay(attempt int) time.Duration {
+	if attempt > 6 {
+		return time.Minute
+	}
+	return time.Second << uint(attempt)
+}
+
+// sqlRow returns the column values of the json or binary encoded message
+// msg received at now.
+func sqlRow(msg []byte, now time.Time) ([]interface{}, error) {
+	var m Msg
+	err := m.BinaryDecode(msg)
+	if err == ErrUnknownEncoding {
+		err = m.JSONDecode(msg)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "decode message")
+	}
+	stamp, err := time.Parse("2006-01-02 15:04:05", m.Stamp)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode message stamp")
+	}
+	// host, utime and rtime have their own column, other additional
+	// fields are stored as a json object
+	var host, utime, extra interface{}
+	receivedAt := now
+	extras := make(Fields, 0, len(m.Extra))
+	for _, f := range m.Extra {
+		switch f.Key {
+		case "host":
+			host = jsonString(f.Value)
+		case "utime":
+			if t, err := strconv.ParseInt(jsonString(f.Value), 10, 64); err == nil {
+				utime = t
+			}
+		case "rtime":
+			if t, err := time.Parse(time.RFC3339Nano, jsonString(f.Value)); err == nil {
+				receivedAt = t.UTC()
+			}
+		default:
+			extras = append(extras, f)
+		}
+	}
+	if len(extras) > 0 {
+		extra = string(extras.AppendJSON(nil))
+	}
+	return []interface{}{stamp, m.Level, m.System, m.Component, m.Message, host, utime, receivedAt, extra}, nil
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c9s/goprocinfo/linux"
@@ -21,6 +23,17 @@ type Stats struct {
 	cpuTicks   uint64
 	idleTicks  uint64
 	totalTicks uint64
+	nbrRejects uint64
+	rawIn      uint64 // size of compressed received messages
+	wireIn     uint64 // size of received compressed data
+	rawOut     uint64 // size of compressed forwarded messages
+	wireOut    uint64 // size of forwarded compressed data
+	connOpen   int64  // number of open connections
+	connAcc    uint64 // number of accepted connections
+	connRef    uint64 // number of connections refused above the limit
+	acceptErr  uint64 // number of failed accepts
+	oMtx       sync.Mutex
+	outputs    []*outputQueue
 }
 
 // NewStats returns a Stats object.
@@ -44,6 +57,53 @@ func (s *Stats) Update(msgLen int) {
 	s.nbrMsg++
 }
 
+// Reject counts a rejected message.
+func (s *Stats) Reject() {
+	atomic.AddUint64(&s.nbrRejects, 1)
+}
+
+// CompressedIn accumulates the size of received messages and the size of
+// the compressed data they were received in.
+func (s *Stats) CompressedIn(raw, wire int) {
+	atomic.AddUint64(&s.rawIn, uint64(raw))
+	atomic.AddUint64(&s.wireIn, uint64(wire))
+}
+
+// CompressedOut accumulates the size of forwarded messages and the size of
+// the compressed data they were sent in.
+func (s *Stats) CompressedOut(raw, wire int) {
+	atomic.AddUint64(&s.rawOut, uint64(raw))
+	atomic.AddUint64(&s.wireOut, uint64(wire))
+}
+
+// ConnAccepted counts an accepted connection.
+func (s *Stats) ConnAccepted() {
+	atomic.AddUint64(&s.connAcc, 1)
+	atomic.AddInt64(&s.connOpen, 1)
+}
+
+// ConnClosed counts the close of an accepted connection.
+func (s *Stats) ConnClosed() {
+	atomic.AddInt64(&s.connOpen, -1)
+}
+
+// ConnRefused counts a connection refused above the connection limit.
+func (s *Stats) ConnRefused() {
+	atomic.AddUint64(&s.connRef, 1)
+}
+
+// AcceptFailed counts a failed accept.
+func (s *Stats) AcceptFailed() {
+	atomic.AddUint64(&s.acceptErr, 1)
+}
+
+// AddOutput adds the queue of an output to the displayed stats.
+func (s *Stats) AddOutput(o *outputQueue) {
+	s.oMtx.Lock()
+	s.outputs = append(s.outputs, o)
+	s.oMtx.Unlock()
+}
+
 // Display log print the current stats.
 func (s *Stats) display() {
 	now := time.Now()
@@ -64,6 +124,28 @@ func (s *Stats) display() {
 	idle := 100 * float64(idleTicks-s.idleTicks) / float64(totalTicks-s.totalTicks)
 	log.Printf("%.3f usec/msg, %.3f B/msg, %.3f kHz, %.3f MB/s, cpu: %.1f%% idle: %.1f%%\n",
 		usmsg, mLen, rate/1000, mbs, cpu, idle)
+	rawIn, wireIn := atomic.SwapUint64(&s.rawIn, 0), atomic.SwapUint64(&s.wireIn, 0)
+	rawOut, wireOut := atomic.SwapUint64(&s.rawOut, 0), atomic.SwapUint64(&s.wireOut, 0)
+	if wireIn > 0 {
+		log.Printf("compression ratio of received messages: %.2f\n", float64(rawIn)/float64(wireIn))
+	}
+	if wireOut > 0 {
+		log.Printf("compression ratio of forwarded messages: %.2f\n", float64(rawOut)/float64(wireOut))
+	}
+	if rejects := atomic.SwapUint64(&s.nbrRejects, 0); rejects > 0 {
+		log.Printf("rejected %d messages\n", rejects)
+	}
+	accepted, refused := atomic.SwapUint64(&s.connAcc, 0), atomic.SwapUint64(&s.connRef, 0)
+	if failed := atomic.SwapUint64(&s.acceptErr, 0); accepted > 0 || refused > 0 || failed > 0 {
+		log.Printf("connections: %d open, %d accepted, %d refused, %d accept errors\n",
+			atomic.LoadInt64(&s.connOpen), accepted, refused, failed)
+	}
+	s.oMtx.Lock()
+	for _, o := range s.outputs {
+		log.Printf("output %s: queue %d/%d, dropped %d\n",
+			o.name, len(o.msgs), cap(o.msgs), atomic.SwapUint64(&o.dropped, 0))
+	}
+	s.oMtx.Unlock()
 
 	s.nbrMsg = 0
 	s.accMsgLen = 0
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	l "log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// syslogLevels are the level names of the syslog severities.
+var syslogLevels = [8]string{"FATAL", "FATAL", "FATAL", "ERROR", "WARN", "NOTICE", "INFO", "DEBUG"}
+
+// syslogFacilities are the names of the syslog facilities.
+var syslogFacilities = [24]string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// maxSyslogSenders is the maximum number of senders whose token bucket is
+// kept by a datagram listener.
+const maxSyslogSenders = 1024
+
+// syslogReceiver converts the syslog messages received on a listener and
+// queues them in the fair queue.
+type syslogReceiver struct {
+	fq        *fairQueue
+	stop      <-chan struct{} // closed to interrupt the rate limit delays
+	printMsg  bool
+	stats     *Stats
+	log       *l.Logger
+	rejects   uint64 // updated atomically, shared by the connections of the listener
+	throttles uint64 // updated atomically, shared by the connections of the listener
+}
+
+// startSyslog starts the syslog listeners of the comma separated URLs
+// (e.g. udp://:514,tcp://:514,tls://:6514). TLS listeners use the
+// certificates of config, and verify the client certificates when given.
+// The received connections are added to conns, and their messages queued in
+// fq. It returns the listeners to close on shutdown.
+func startSyslog(urls string, config *tls.Config, fq *fairQueue, conns *connSet, printMsg bool, stats *Stats) ([]io.Closer, error) {
+	var closers []io.Closer
+	for _, rawURL := range splitAddresses(urls) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return closers, errors.Wrap(err, "syslog listen URL")
+		}
+		s := &syslogReceiver{
+			fq:       fq,
+			stop:     conns.stopping(),
+			printMsg: printMsg,
+			stats:    stats,
+			log:      l.New(os.Stdout, "syslog  ", l.Flags()),
+		}
+		switch u.Scheme {
+		case "udp":
+			addr, err := net.ResolveUDPAddr("udp", u.Host)
+			if err != nil {
+				return closers, errors.Wrap(err, "syslog listen")
+			}
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				return closers, errors.Wrap(err, "syslog listen")
+			}
+			conns.add(conn)
+			closers = append(closers, conn)
+			go func() {
+				defer conns.remove(conn)
+				s.receivePackets(conn)
+			}()
+		case "tcp", "tls":
+			var listener net.Listener
+			if u.Scheme == "tls" {
+				c := config.Clone()
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+				listener, err = tls.Listen("tcp", u.Host, c)
+			} else {
+				listener, err = net.Listen("tcp", u.Host)
+			}
+			if err != nil {
+				return closers, errors.Wrap(err, "syslog listen")
+			}
+			closers = append(closers, listener)
+			go newAcceptor(listener, conns, *maxConnsFlag, stats, s.log, s.receiveStream, nil).run()
+		default:
+			return closers, errors.Errorf("invalid syslog listen URL '%s', expected udp, tcp or tls scheme", rawURL)
+		}
+		s.log.Println("listen:", rawURL)
+	}
+	return closers, nil
+}
+
+// receivePackets receives one syslog message per datagram on conn.
+// Datagrams are not enriched with the fields of a connection. Each sender
+// address has its own queue, and the rate of each sender is limited.
+func (s *syslogReceiver) receivePackets(conn *net.UDPConn) {
+	type sender struct {
+		msgs   *clientQueue
+		bucket *tokenBucket // nil when not limited
+	}
+	enr := newEnricher(nil, "syslog", enrichFields)
+	senders := make(map[string]sender) // by source IP address
+	defer func() {
+		for _, snd := range senders {
+			rateLimits.release(snd.bucket)
+		}
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				s.log.Println("recv datagram:", err)
+			}
+			return
+		}
+		ip := addr.IP.String()
+		snd, ok := senders[ip]
+		if !ok {
+			if len(senders) == maxSyslogSenders {
+				// forget the senders rather than keeping one per source
+				// address, their queued messages are still sent
+				for k, snd := range senders {
+					rateLimits.release(snd.bucket)
+					delete(senders, k)
+				}
+			}
+			snd.msgs = s.fq.newQueue()
+			if rateLimits != nil {
+				snd.bucket = rateLimits.acquire(rateLimits.addrKey(addr, "syslog"))
+			}
+			senders[ip] = snd
+		}
+		s.receivePacket(buf[:n], enr, snd.msgs, snd.bucket)
+	}
+}
+
+// receiveStream receives syslog messages framed by octet counting or
+// terminated by a newline (RFC 6587) on conn.
+func (s *syslogReceiver) receiveStream(conn net.Conn) {
+	defer conn.Close()
+	name := conn.RemoteAddr().String()
+	s.log.Println("accept:", name, "->", conn.LocalAddr())
+	enr := newEnricher(conn, "syslog", enrichFields)
+	msgs := s.fq.newQueue()
+	var bucket *tokenBucket // nil when the sender rate is not limited
+	if rateLimits != nil {
+		bucket = rateLimits.acquire(rateLimits.clientKey(conn, "syslog"))
+		defer rateLimits.release(bucket)
+	}
+	r := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		frame, err := readSyslogFrame(r)
+		if err != nil {
+			if errors.Cause(err) == ErrFrameTooLarge {
+				s.reject(err)
+				continue
+			}
+			if err != io.EOF {
+				s.log.Println("recv:", err)
+			}
+			s.log.Println("closing connection with", name)
+			return
+		}
+		s.receive(frame, enr, msgs, bucket)
+	}
+}
+
+// readSyslogFrame returns the next message of a syslog stream. A frame
+// starting with a digit is octet counted, others end with a newline.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	c, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if c[0] >= '0' && c[0] <= '9' {
+		// the octet count of a frame that can be skipped has at most one
+		// digit more than the maximum message size
+		maxLen := len(strconv.Itoa(*maxMsgFlag)) + 2
+		count := make([]byte, 0, maxLen)
+		for len(count) == 0 || count[len(count)-1] != ' ' {
+			if len(count) == maxLen {
+				return nil, errors.Errorf("invalid octet count '%s...'", count)
+			}
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, errors.Wrap(err, "read octet count")
+			}
+			count = append(count, c)
+		}
+		n, err := strconv.Atoi(string(count[:len(count)-1]))
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid octet count '%s'", count)
+		}
+		if n > *maxMsgFlag {
+			if _, err = io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+				return nil, err
+			}
+			return nil, errors.Wrapf(ErrFrameTooLarge, "message size %d exceeds limit %d", n, *maxMsgFlag)
+		}
+		frame := make([]byte, n)
+		_, err = io.ReadFull(r, frame)
+		return frame, err
+	}
+	var frame []byte
+	tooLarge := false
+	for {
+		line, err := r.ReadSlice('\n')
+		if tooLarge || len(frame)+len(line) > *maxMsgFlag {
+			// skip the line so that the connection remains usable
+			tooLarge = true
+		} else {
+			frame = append(frame, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLarge && (err == nil || err == io.EOF) {
+			return nil, errors.Wrapf(ErrFrameTooLarge, "message size exceeds limit %d", *maxMsgFlag)
+		}
+		if err == io.EOF && len(frame) > 0 {
+			return frame, nil
+		}
+		return frame, err
+	}
+}
+
+// receive converts the syslog message data and queues it in msgs, once
+// the rate limit of bucket allows it.
+func (s *syslogReceiver) receive(data []byte, enr *enricher, msgs *clientQueue, bucket *tokenBucket) {
+	if bucket != nil {
+		if delay := bucket.wait(1, s.stop); delay > 0 {
+			if n := atomic.AddUint64(&s.throttles, 1); n%1000 == 1 {
+				s.log.Printf("rate limit of %s exceeded, delay %v (%d delayed)", bucket.key, delay, n)
+			}
+		}
+	}
+	buf, err := s.convert(data, enr)
+	if err != nil {
+		s.reject(err)
+		return
+	}
+	msgs.push(msgItem{data: buf})
+	s.stats.Update(len(buf))
+}
+
+// receivePacket converts the syslog message of a datagram and queues it in
+// msgs. As waiting would delay the datagrams of all the senders, the
+// datagram is dropped when the rate limit of bucket is exceeded or msgs is
+// full.
+func (s *syslogReceiver) receivePacket(data []byte, enr *enricher, msgs *clientQueue, bucket *tokenBucket) {
+	if bucket != nil && !bucket.allow(1) {
+		if n := atomic.AddUint64(&s.throttles, 1); n%1000 == 1 {
+			s.log.Printf("rate limit of %s exceeded, drop datagram (%d dropped)", bucket.key, n)
+		}
+		s.stats.Reject()
+		return
+	}
+	buf, err := s.convert(data, enr)
+	if err == nil {
+		err = msgs.tryPush([]msgItem{{data: buf}})
+	}
+	if err != nil {
+		s.reject(err)
+		return
+	}
+	s.stats.Update(len(buf))
+}
+
+// convert returns the enriched json message of the syslog message data.
+func (s *syslogReceiver) convert(data []byte, enr *enricher) ([]byte, error) {
+	m, err := parseSyslog(data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	buf, err := m.JSONEncode()
+	if err == nil {
+		err = checkMsg(buf)
+	}
+	if err == nil {
+		buf, err = enr.enrich(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.printMsg {
+		s.log.Println("msg:", string(buf))
+	}
+	return buf, nil
+}
+
+// reject drops a message that can't be accepted.
+func (s *syslogReceiver) reject(err error) {
+	if n := atomic.AddUint64(&s.rejects, 1); n%1000 == 1 {
+		s.log.Printf("reject message: %v (%d rejected)", err, n)
+	}
+	s.stats.Reject()
+}
+
+// parseSyslog returns the message of the RFC 5424 or RFC 3164 syslog message
+// data received at now. The severity is the level, the app-name or tag the
+// component, and the hostname, facility, procid, msgid and structured data
+// parameters (named sd-id.param-name) are extra fields.
+func parseSyslog(data []byte, now time.Time) (*Msg, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	if len(data) < 3 || data[0] != '<' {
+		return nil, errors.New("syslog: missing priority")
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("syslog: invalid priority")
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, errors.Errorf("syslog: invalid priority '%s'", data[1:end])
+	}
+	data = data[end+1:]
+	m := &Msg{
+		Stamp: now.UTC().Format("2006-01-02 15:04:05"),
+		Level: syslogLevels[pri%8],
+	}
+	m.Extra.Set("facility", appendJSONString(nil, syslogFacilities[pri/8]))
+	if bytes.HasPrefix(data, []byte("1 ")) {
+		err = parseSyslog5424(m, data[2:])
+	} else {
+		parseSyslog3164(m, data, now)
+	}
+	return m, err
+}
+
+// parseSyslog5424 sets the fields of m from the RFC 5424 message data
+// following the version.
+func parseSyslog5424(m *Msg, data []byte) error {
+	var fields [5][]byte // timestamp, hostname, app-name, procid, msgid
+	for i := range fields {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return errors.New("syslog: truncated header")
+		}
+		fields[i], data = data[:sp], data[sp+1:]
+	}
+	if string(fields[0]) != "-" {
+		t, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+		if err != nil {
+			return errors.Errorf("syslog: invalid timestamp '%s'", fields[0])
+		}
+		m.Stamp = t.UTC().Format("2006-01-02 15:04:05")
+	}
+	if string(fields[2]) != "-" {
+		m.Component = string(fields[2])
+	}
+	for i, key := range [...]string{1: "host", 3: "procid", 4: "msgid"} {
+		if key != "" && string(fields[i]) != "-" {
+			m.Extra.Set(key, appendJSONString(nil, string(fields[i])))
+		}
+	}
+	data, err := parseStructuredData(m, data)
+	if err != nil {
+		return err
+	}
+	data = bytes.TrimPrefix(bytes.TrimPrefix(data, []byte(" ")), []byte("\xef\xbb\xbf"))
+	m.Message = string(data)
+	return nil
+}
+
+// parseStructuredData adds the parameters of the structured data at the start
+// of data to the extra fields of m, and returns the data following them.
+func parseStructuredData(m *Msg, data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] == '-' {
+		if len(data) > 0 {
+			data = data[1:]
+		}
+		return data, nil
+	}
+	for len(data) > 0 && data[0] == '[' {
+		i := bytes.IndexAny(data, " ]")
+		if i < 0 {
+			return nil, errors.New("syslog: truncated structured data")
+		}
+		id := string(data[1:i])
+		data = data[i:]
+		for data[0] == ' ' {
+			// param-name="param-value" with \", \\ and \] escaped
+			eq := bytes.Index(data, []byte(`="`))
+			if eq < 0 {
+				return nil, errors.New("syslog: invalid structured data parameter")
+			}
+			name := id + "." + string(data[1:eq])
+			data = data[eq+2:]
+			var value []byte
+			for i = 0; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) && (data[i+1] == '"' || data[i+1] == '\\' || data[i+1] == ']') {
+					i++
+				}
+				value = append(value, data[i])
+			}
+			if i+1 >= len(data) {
+				return nil, errors.New("syslog: truncated structured data")
+			}
+			m.Extra.Set(name, appendJSONString(nil, string(value)))
+			data = data[i+1:]
+		}
+		if data[0] != ']' {
+			return nil, errors.New("syslog: invalid structured data")
+		}
+		data = data[1:]
+	}
+	return data, nil
+}
+
+// parseSyslog3164 sets the fields of m from the RFC 3164 message data
+// following the priority. The year of the timestamp is the one of now, and
+// the hostname is optional. Data without a valid timestamp is the message.
+func parseSyslog3164(m *Msg, data []byte, now time.Time) {
+	const stampLayout = "Jan _2 15:04:05"
+	if len(data) < len(stampLayout)+1 || data[len(stampLayout)] != ' ' {
+		m.Message = string(data)
+		return
+	}
+	t, err := time.ParseInLocation(stampLayout, string(data[:len(stampLayout)]), now.Location())
+	if err != nil {
+		m.Message = string(data)
+		return
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		// sent in December, received in January
+		t = t.AddDate(-1, 0, 0)
+	}
+	m.Stamp = t.UTC().Format("2006-01-02 15:04:05")
+	data = data[len(stampLayout)+1:]
+
+	// the hostname is omitted when the first word is a tag
+	if sp := bytes.IndexByte(data, ' '); sp > 0 && bytes.IndexAny(data[:sp], ":[") < 0 {
+		m.Extra.Set("host", appendJSONString(nil, string(data[:sp])))
+		data = data[sp+1:]
+	}
+	// TAG[pid]: or TAG:
+	if i := bytes.IndexAny(data, ":[ "); i > 0 && i <= 32 && data[i] != ' ' {
+		tag, rest, pid := data[:i], data[i:], []byte(nil)
+		if rest[0] == '[' {
+			if j := bytes.IndexByte(rest, ']'); j > 0 {
+				pid, rest = rest[1:j], rest[j+1:]
+			}
+		}
+		if len(rest) > 0 && rest[0] == ':' {
+			m.Component = string(tag)
+			if pid != nil {
+				m.Extra.Set("procid", appendJSONString(nil, string(pid)))
+			}
+			data = bytes.TrimPrefix(rest[1:], []byte(" "))
+		}
+	}
+	m.Message = string(data)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	l "log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		data      string
+		now       time.Time
+		stamp     string
+		level     string
+		component string
+		message   string
+		extra     string // json encoded extra fields
+		err       string
+	}{
+		{
+			name:      "rfc5424 without structured data",
+			data:      "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed for lonvick on /dev/pts/8",
+			stamp:     "2003-10-11 22:14:15",
+			level:     "FATAL",
+			component: "su",
+			message:   "'su root' failed for lonvick on /dev/pts/8",
+			extra:     `{"facility":"auth","host":"mymachine.example.com","msgid":"ID47"}`,
+		},
+		{
+			name:      "rfc5424 with time offset and BOM",
+			data:      "<165>1 2003-08-24T05:14:15.000003-07:00 192.0.2.1 myproc 8710 - - \xef\xbb\xbf%% It's time to make the do-nuts.",
+			stamp:     "2003-08-24 12:14:15",
+			level:     "NOTICE",
+			component: "myproc",
+			message:   "%% It's time to make the do-nuts.",
+			extra:     `{"facility":"local4","host":"192.0.2.1","procid":"8710"}`,
+		},
+		{
+			name:      "rfc5424 with structured data",
+			data:      `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] An application event log entry...`,
+			stamp:     "2003-10-11 22:14:15",
+			level:     "NOTICE",
+			component: "evntslog",
+			message:   "An application event log entry...",
+			extra:     `{"facility":"local4","host":"mymachine.example.com","msgid":"ID47","exampleSDID@32473.iut":"3","exampleSDID@32473.eventSource":"Application","exampleSDID@32473.eventID":"1011"}`,
+		},
+		{
+			name:      "rfc5424 with structured data and no message",
+			data:      `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3"][examplePriority@32473 class="high"]` + "\n",
+			stamp:     "2003-10-11 22:14:15",
+			level:     "NOTICE",
+			component: "evntslog",
+			extra:     `{"facility":"local4","host":"mymachine.example.com","msgid":"ID47","exampleSDID@32473.iut":"3","examplePriority@32473.class":"high"}`,
+		},
+		{
+			name:  "rfc5424 nil values",
+			data:  "<0>1 - - - - - -",
+			stamp: "2026-10-17 12:00:00",
+			level: "FATAL",
+			extra: `{"facility":"kern"}`,
+		},
+		{
+			name:      "rfc3164",
+			data:      "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			stamp:     "2026-10-11 22:14:15",
+			level:     "FATAL",
+			component: "su",
+			message:   "'su root' failed for lonvick on /dev/pts/8",
+			extra:     `{"facility":"auth","host":"mymachine"}`,
+		},
+		{
+			name:      "rfc3164 without hostname and with pid",
+			data:      "<13>Feb  5 17:32:18 sshd[123]: Accepted publickey\r\n",
+			stamp:     "2026-02-05 17:32:18",
+			level:     "NOTICE",
+			component: "sshd",
+			message:   "Accepted publickey",
+			extra:     `{"facility":"user","procid":"123"}`,
+		},
+		{
+			name:    "rfc3164 sent in December and received in January",
+			data:    "<14>Dec 31 23:59:59 host message",
+			now:     time.Date(2027, 1, 1, 0, 0, 1, 0, time.UTC),
+			stamp:   "2026-12-31 23:59:59",
+			level:   "INFO",
+			message: "message",
+			extra:   `{"facility":"user","host":"host"}`,
+		},
+		{
+			name:    "rfc3164 without timestamp",
+			data:    "<191>hello world",
+			stamp:   "2026-10-17 12:00:00",
+			level:   "DEBUG",
+			message: "hello world",
+			extra:   `{"facility":"local7"}`,
+		},
+		{name: "empty", data: "", err: "syslog: missing priority"},
+		{name: "missing priority", data: "hello world", err: "syslog: missing priority"},
+		{name: "empty priority", data: "<>hello", err: "syslog: invalid priority"},
+		{name: "unterminated priority", data: "<13 hello", err: "syslog: invalid priority"},
+		{name: "priority out of range", data: "<192>hello", err: "syslog: invalid priority '192'"},
+		{name: "priority not a number", data: "<1a>hello", err: "syslog: invalid priority '1a'"},
+		{name: "truncated rfc5424 header", data: "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su", err: "syslog: truncated header"},
+		{name: "invalid rfc5424 timestamp", data: "<34>1 yesterday host app - - - msg", err: "syslog: invalid timestamp 'yesterday'"},
+		{name: "truncated structured data", data: `<34>1 - host app - - [id a="b`, err: "syslog: truncated structured data"},
+		{name: "invalid structured data", data: `<34>1 - host app - - [id a=b] msg`, err: "syslog: invalid structured data parameter"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			at := now
+			if !test.now.IsZero() {
+				at = test.now
+			}
+			m, err := parseSyslog([]byte(test.data), at)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Stamp != test.stamp || m.Level != test.level || m.Component != test.component || m.Message != test.message {
+				t.Errorf("expected %q %q %q %q, got %q %q %q %q", test.stamp, test.level, test.component, test.message,
+					m.Stamp, m.Level, m.Component, m.Message)
+			}
+			if extra := string(m.Extra.AppendJSON(nil)); extra != test.extra {
+				t.Errorf("expected extra fields %s, got %s", test.extra, extra)
+			}
+		})
+	}
+}
+
+func TestParseStructuredData(t *testing.T) {
+	tests := []struct {
+		data  string
+		rest  string
+		extra string // json encoded extra fields
+		err   string
+	}{
+		{data: "", rest: "", extra: "{}"},
+		{data: "-", rest: "", extra: "{}"},
+		{data: "- msg", rest: " msg", extra: "{}"},
+		{data: "[id] msg", rest: " msg", extra: "{}"},
+		{data: `[id a="1"]`, rest: "", extra: `{"id.a":"1"}`},
+		{data: `[id a="1" b=""][id2 c="3"] msg`, rest: " msg", extra: `{"id.a":"1","id.b":"","id2.c":"3"}`},
+		{data: `[id a="q\"b\\s\]e\n"]`, rest: "", extra: `{"id.a":"q\"b\\s]e\\n"}`},
+		{data: `[id a="x]y"]`, rest: "", extra: `{"id.a":"x]y"}`},
+		{data: `[id a="caf` + "\xff" + `"]`, rest: "", extra: `{"id.a":"caf\ufffd"}`},
+		{data: "[id", err: "syslog: truncated structured data"},
+		{data: `[id a="1`, err: "syslog: truncated structured data"},
+		{data: `[id a="1"`, err: "syslog: truncated structured data"},
+		{data: `[id a="1\"`, err: "syslog: truncated structured data"},
+		{data: "[id ", err: "syslog: invalid structured data parameter"},
+		{data: "[id a=1]", err: "syslog: invalid structured data parameter"},
+		{data: `[id a="1" ]`, err: "syslog: invalid structured data parameter"},
+		{data: `[id a="1"x]`, err: "syslog: invalid structured data"},
+	}
+	for _, test := range tests {
+		m := &Msg{}
+		rest, err := parseStructuredData(m, []byte(test.data))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: expected error %q, got %v", test.data, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.data, err)
+			continue
+		}
+		if string(rest) != test.rest {
+			t.Errorf("%q: expected rest %q, got %q", test.data, test.rest, rest)
+		}
+		if extra := string(m.Extra.AppendJSON(nil)); extra != test.extra {
+			t.Errorf("%q: expected extra fields %s, got %s", test.data, test.extra, extra)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	defer func(maxMsg int) { *maxMsgFlag = maxMsg }(*maxMsgFlag)
+	tests := []struct {
+		name   string
+		data   string
+		maxMsg int
+		frames []string // frames read until an error other than a too large frame, as "error: " and the error
+	}{
+		{
+			name:   "octet counting",
+			data:   "9 <13>hello8 <13>abcd",
+			frames: []string{"<13>hello", "<13>abcd", "error: EOF"},
+		},
+		{
+			name:   "octet counting with newlines",
+			data:   "10 <13>hello\n0 ",
+			frames: []string{"<13>hello\n", "", "error: EOF"},
+		},
+		{
+			name:   "newline",
+			data:   "<13>a\n<13>b\n",
+			frames: []string{"<13>a\n", "<13>b\n", "error: EOF"},
+		},
+		{
+			name:   "newline without final newline",
+			data:   "<13>a\n<13>b",
+			frames: []string{"<13>a\n", "<13>b", "error: EOF"},
+		},
+		{
+			name:   "line longer than the reader buffer",
+			data:   "<13>" + strings.Repeat("x", 40) + "\n<13>b\n",
+			frames: []string{"<13>" + strings.Repeat("x", 40) + "\n", "<13>b\n", "error: EOF"},
+		},
+		{
+			name:   "mixed framing",
+			data:   "<13>a\n5 <13>b<13>c\n",
+			frames: []string{"<13>a\n", "<13>b", "<13>c\n", "error: EOF"},
+		},
+		{
+			name:   "truncated octet counted frame",
+			data:   "20 <13>short",
+			frames: []string{"error: unexpected EOF"},
+		},
+		{
+			name:   "truncated octet count",
+			data:   "12",
+			frames: []string{"error: read octet count: EOF"},
+		},
+		{
+			name:   "invalid octet count",
+			data:   "1x2 <13>a",
+			frames: []string{"error: invalid octet count '1x2 '"},
+		},
+		{
+			name:   "too long octet count",
+			data:   strings.Repeat("9", 40) + " <13>a",
+			maxMsg: 8,
+			frames: []string{"error: invalid octet count '999...'"},
+		},
+		{
+			name:   "skipped octet count",
+			data:   "99 " + strings.Repeat("x", 99) + "5 <13>a",
+			maxMsg: 8,
+			frames: []string{"error: message size 99 exceeds limit 8: frame too large", "<13>a", "error: EOF"},
+		},
+		{
+			name:   "too large octet counted frame",
+			data:   "10 <13>abcdef5 <13>a",
+			maxMsg: 8,
+			frames: []string{"error: message size 10 exceeds limit 8: frame too large", "<13>a", "error: EOF"},
+		},
+		{
+			name:   "truncated too large octet counted frame",
+			data:   "10 <13>abc",
+			maxMsg: 8,
+			frames: []string{"error: EOF"},
+		},
+		{
+			name:   "too large line",
+			data:   "<13>abcdef\n<13>a\n",
+			maxMsg: 8,
+			frames: []string{"error: message size exceeds limit 8: frame too large", "<13>a\n", "error: EOF"},
+		},
+		{
+			name:   "too large line longer than the reader buffer",
+			data:   "<13>" + strings.Repeat("x", 40) + "\n<13>a",
+			maxMsg: 8,
+			frames: []string{"error: message size exceeds limit 8: frame too large", "<13>a", "error: EOF"},
+		},
+		{
+			name:   "too large last line",
+			data:   "<13>abcdef",
+			maxMsg: 8,
+			frames: []string{"error: message size exceeds limit 8: frame too large", "error: EOF"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*maxMsgFlag = 1024 * 1024
+			if test.maxMsg > 0 {
+				*maxMsgFlag = test.maxMsg
+			}
+			r := bufio.NewReaderSize(strings.NewReader(test.data), 16)
+			var frames []string
+			for len(frames) < 10 {
+				frame, err := readSyslogFrame(r)
+				if err == nil {
+					frames = append(frames, string(frame))
+					continue
+				}
+				frames = append(frames, "error: "+err.Error())
+				if !strings.HasSuffix(err.Error(), ErrFrameTooLarge.Error()) {
+					break
+				}
+			}
+			if strings.Join(frames, "|") != strings.Join(test.frames, "|") {
+				t.Errorf("expected frames %q, got %q", test.frames, frames)
+			}
+		})
+	}
+}
+
+func TestReceivePacketsRateLimit(t *testing.T) {
+	defer func(r *rateLimiter) { rateLimits = r }(rateLimits)
+	var err error
+	if rateLimits, err = parseRateLimits("*=1:2", "ip"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan msgItem, 10)
+	fq := newFairQueue(out)
+	go fq.run()
+	defer fq.close()
+	stats := &Stats{}
+	s := &syslogReceiver{fq: fq, stop: make(chan struct{}), stats: stats, log: l.New(io.Discard, "", 0)}
+	done := make(chan struct{})
+	go func() {
+		s.receivePackets(conn)
+		close(done)
+	}()
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	// the datagrams over the burst are dropped without waiting
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for i := 0; i < 5; i++ {
+		if _, err = sender.Write([]byte("<13>hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-out:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 2 messages queued, got %d", i)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&stats.nbrRejects) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&stats.nbrRejects); n != 3 {
+		t.Errorf("expected 3 datagrams dropped, got %d", n)
+	}
+	if n := atomic.LoadUint64(&s.throttles); n != 3 {
+		t.Errorf("expected 3 datagrams throttled, got %d", n)
+	}
+	select {
+	case item := <-out:
+		t.Errorf("unexpected message %s", item.data)
+	default:
+	}
+}
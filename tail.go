@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tailPollPeriod is the period at which the tailed files are read.
+const tailPollPeriod = 250 * time.Millisecond
+
+// fileID identifies a file independently of its name.
+type fileID struct {
+	Dev uint64 `json:"dev"`
+	Ino uint64 `json:"ino"`
+}
+
+// tailFile is a log file followed by the shipper.
+type tailFile struct {
+	id      fileID
+	path    string
+	file    *os.File
+	offset  int64  // offset of the next byte read
+	acked   int64  // offset following the last acknowledged line
+	gen     int    // number of truncations, the lines sent before are not acknowledged
+	partial []byte // incomplete last line
+	seen    bool   // the file matched a pattern at the last scan
+}
+
+// registryEntry is the acknowledged offset of a file stored in the registry.
+type registryEntry struct {
+	fileID
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// pendingLine is a line sent and not yet acknowledged.
+type pendingLine struct {
+	file *tailFile
+	gen  int   // generation of file when the line was sent
+	end  int64 // offset following the line
+	done bool  // acknowledged
+}
+
+// shipper sends the lines appended to the files matching glob patterns as
+// messages, and stores in a registry file the offsets of the acknowledged
+// lines, so that it resumes where it stopped when restarted.
+type shipper struct {
+	patterns []string
+	regexp   *regexp.Regexp // parser of the lines, json lines if nil
+	binary   bool           // send binary encoded messages
+	registry string         // path of the registry file
+	saved    map[fileID]registryEntry
+	files    map[fileID]*tailFile
+	buf      []byte
+	mtx      sync.Mutex // protects pending, first and the acked offsets
+	pending  []pendingLine
+	first    uint64 // sequence number of pending[0]
+	changed  bool   // acked offsets changed since the registry was saved
+}
+
+// newShipper returns a shipper of the files matching the comma separated
+// glob patterns. Lines are parsed with the regular expression expr, or as
+// json if expr is empty.
+func newShipper(patterns, expr, registry string) (*shipper, error) {
+	s := &shipper{
+		patterns: splitAddresses(patterns),
+		registry: registry,
+		saved:    make(map[fileID]registryEntry),
+		files:    make(map[fileID]*tailFile),
+		buf:      make([]byte, 64*1024),
+	}
+	if expr != "" {
+		var err error
+		if s.regexp, err = regexp.Compile(expr); err != nil {
+			return nil, errors.Wrap(err, "line regular expression")
+		}
+	}
+	data, err := ioutil.ReadFile(registry)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read registry")
+	}
+	if len(data) > 0 {
+		var entries []registryEntry
+		if err = json.Unmarshal(data, &entries); err != nil {
+			return nil, errors.Wrap(err, "decode registry")
+		}
+		for _, e := range entries {
+			s.saved[e.fileID] = e
+		}
+	}
+	return s, nil
+}
+
+// runAsShipper tails the files matching patterns and forwards their lines
+// to the logCollector at addresses.
+func runAsShipper(patterns string, addresses []string, keyFile, crtFile string, certPool *x509.CertPool, stats *Stats) {
+	s, err := newShipper(patterns, *regexFlag, *registryFlag)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	s.binary = splitAddresses(*encodingFlag)[0] == "B"
+	log.Println("tail:", patterns, "registry:", s.registry)
+
+	q := newOutputQueue("fwd", 1000)
+	q.acks = true // offsets are saved once lines are acknowledged
+	done := make(chan struct{})
+	go func() {
+		runOutput(newFwdState(addresses, keyFile, crtFile, certPool), q, maxMsgs, stats)
+		close(done)
+	}()
+
+	shutdown := shutdownSignal()
+	send := func(msg []byte, ack *msgAck) bool {
+		select {
+		case q.msgs <- msgItem{data: msg, ack: ack}:
+			stats.Update(len(msg))
+			return true
+		case <-shutdown:
+			return false
+		}
+	}
+	ticker := time.NewTicker(tailPollPeriod)
+	defer ticker.Stop()
+	lastScan, lastSave := time.Time{}, time.Now()
+	for running := true; running; {
+		select {
+		case <-shutdown:
+			running = false
+			continue
+		case <-ticker.C:
+		}
+		if time.Since(lastScan) >= time.Second {
+			s.scan()
+			lastScan = time.Now()
+		}
+		running = s.readFiles(send)
+		if time.Since(lastSave) >= time.Second {
+			s.saveRegistry()
+			lastSave = time.Now()
+		}
+	}
+
+	// wait until the queued lines are acknowledged
+	close(q.msgs)
+	select {
+	case <-done:
+		log.Println("shutdown: done")
+	case <-time.After(time.Duration(*shutdownFlag) * time.Second):
+		log.Println("shutdown: drain deadline exceeded, pending lines will be sent again")
+	}
+	s.saveRegistry()
+}
+
+// scan opens the files matching the patterns that are not yet tailed.
+func (s *shipper) scan() {
+	for _, f := range s.files {
+		f.seen = false
+	}
+	for _, pattern := range s.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Println("tail:", err)
+			continue
+		}
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			id := newFileID(info)
+			if f, ok := s.files[id]; ok {
+				f.seen = true
+				f.path = path // the file may have been renamed
+				continue
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				log.Println("tail:", err)
+				continue
+			}
+			f := &tailFile{id: id, path: path, file: file, seen: true}
+			if e, ok := s.saved[id]; ok && e.Offset <= info.Size() {
+				f.offset, f.acked = e.Offset, e.Offset
+			}
+			s.mtx.Lock()
+			s.files[id] = f
+			s.mtx.Unlock()
+			log.Printf("tail: %s from offset %d", path, f.offset)
+		}
+	}
+}
+
+// newFileID returns the identifier of the file described by info.
+func newFileID(info os.FileInfo) fileID {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}
+	}
+	return fileID{}
+}
+
+// readFiles sends the lines appended to the tailed files. It returns false
+// when send fails. A file that no longer matches the patterns, because it was
+// renamed or deleted, is closed when its end is reached.
+func (s *shipper) readFiles(send func(msg []byte, ack *msgAck) bool) bool {
+	for id, f := range s.files {
+		if info, err := f.file.Stat(); err == nil && info.Size() < f.offset {
+			log.Printf("tail: %s truncated, read from start", f.path)
+			s.mtx.Lock()
+			f.offset, f.acked, f.partial = 0, 0, f.partial[:0]
+			f.gen++
+			s.changed = true
+			s.mtx.Unlock()
+		}
+		for {
+			n, err := f.file.ReadAt(s.buf, f.offset)
+			data := s.buf[:n]
+			for len(data) > 0 {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					f.partial = append(f.partial, data...)
+					f.offset += int64(len(data))
+					break
+				}
+				f.offset += int64(i + 1)
+				line := append(f.partial, data[:i]...)
+				f.partial = f.partial[:0]
+				data = data[i+1:]
+				if !s.sendLine(f, line, send) {
+					return false
+				}
+			}
+			if len(f.partial) > *maxMsgFlag/2 {
+				// send a very long line in pieces
+				if !s.sendLine(f, f.partial, send) {
+					return false
+				}
+				f.partial = f.partial[:0]
+			}
+			if err == io.EOF || n == 0 {
+				break
+			}
+			if err != nil {
+				log.Printf("tail: %s: %v", f.path, err)
+				break
+			}
+		}
+		if !f.seen {
+			if len(f.partial) > 0 {
+				if !s.sendLine(f, f.partial, send) {
+					return false
+				}
+				f.partial = f.partial[:0]
+			}
+			log.Printf("tail: %s done", f.path)
+			f.file.Close()
+			s.mtx.Lock()
+			delete(s.files, id)
+			s.mtx.Unlock()
+		}
+	}
+	return true
+}
+
+// sendLine sends the line ending at the current offset of f.
+func (s *shipper) sendLine(f *tailFile, line []byte, send func(msg []byte, ack *msgAck) bool) bool {
+	line = bytes.TrimRight(line, "\r")
+	s.mtx.Lock()
+	ack := &msgAck{refs: 1, win: s, seq: s.first + uint64(len(s.pending))}
+	s.pending = append(s.pending, pendingLine{file: f, gen: f.gen, end: f.offset})
+	s.mtx.Unlock()
+	return send(s.lineMsg(line), ack)
+}
+
+// lineMsg returns the message of a line. The line is sent unchanged if it is
+// a json object. Otherwise the named groups of the regular expression are the
+// message fields, and the line is the message text when it doesn't match.
+func (s *shipper) lineMsg(line []byte) []byte {
+	if s.regexp == nil && len(line) > 0 && line[0] == '{' && json.Valid(line) {
+		msg := append([]byte{'J'}, line...)
+		if s.binary {
+			// a json object with values that are not strings is sent as json
+			if b, err := transcode(msg, 'B'); err == nil {
+				return b
+			}
+		}
+		return msg
+	}
+	m := Msg{Stamp: time.Now().UTC().Format("2006-01-02 15:04:05"), Message: string(line)}
+	if match := s.findSubmatch(line); match != nil {
+		for i, name := range s.regexp.SubexpNames() {
+			switch name {
+			case "":
+			case "asctime":
+				m.Stamp = string(match[i])
+			case "levelname":
+				m.Level = string(match[i])
+			case "name":
+				m.System = string(match[i])
+			case "componentname":
+				m.Component = string(match[i])
+			case "message":
+				m.Message = string(match[i])
+			default:
+				m.Extra.Set(name, appendJSONString(nil, string(match[i])))
+			}
+		}
+	}
+	var msg []byte
+	if s.binary {
+		msg, _ = m.BinaryEncode(make([]byte, 0, 64+len(line)))
+	} else {
+		msg, _ = m.JSONEncode()
+	}
+	return msg
+}
+
+// findSubmatch returns the submatches of the regular expression in line, or
+// nil if it doesn't match or there is no regular expression.
+func (s *shipper) findSubmatch(line []byte) [][]byte {
+	if s.regexp == nil {
+		return nil
+	}
+	return s.regexp.FindSubmatch(line)
+}
+
+// ack records the acknowledgment of the line seq. Lines are acknowledged
+// in sending order. The offsets of the lines sent before the truncation of
+// their file are ignored.
+func (s *shipper) ack(seq uint64, code byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if seq < s.first || seq-s.first >= uint64(len(s.pending)) {
+		return
+	}
+	s.pending[seq-s.first].done = true
+	n := 0
+	for n < len(s.pending) && s.pending[n].done {
+		p := s.pending[n]
+		if p.gen == p.file.gen && p.end > p.file.acked {
+			p.file.acked = p.end
+		}
+		n++
+	}
+	s.first += uint64(n)
+	s.pending = s.pending[:copy(s.pending, s.pending[n:])]
+	s.changed = s.changed || n > 0
+}
+
+// fail is called when a line is lost by the output. It is sent again when the
+// shipper restarts.
+func (s *shipper) fail() {
+	log.Println("tail: line lost by the output")
+}
+
+// saveRegistry writes the acknowledged offsets in the registry file.
+func (s *shipper) saveRegistry() {
+	s.mtx.Lock()
+	if !s.changed {
+		s.mtx.Unlock()
+		return
+	}
+	entries := make([]registryEntry, 0, len(s.files))
+	for id, f := range s.files {
+		entries = append(entries, registryEntry{fileID: id, Path: f.path, Offset: f.acked})
+	}
+	s.changed = false
+	s.mtx.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmp := s.registry + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0660); err == nil {
+			err = os.Rename(tmp, s.registry)
+		}
+	}
+	if err != nil {
+		log.Println("tail: save registry:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShipperAckAfterTruncation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(path, []byte("first line\nsecond line\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newShipper(path, "", filepath.Join(dir, "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var acks []*msgAck
+	send := func(msg []byte, ack *msgAck) bool {
+		acks = append(acks, ack)
+		return true
+	}
+	s.scan()
+	if !s.readFiles(send) || len(acks) != 2 {
+		t.Fatalf("expected 2 lines sent, got %d", len(acks))
+	}
+
+	// the lines sent before the truncation are acknowledged after it
+	if err = os.WriteFile(path, []byte("new\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if !s.readFiles(send) || len(acks) != 3 {
+		t.Fatalf("expected 3 lines sent, got %d", len(acks))
+	}
+	for _, ack := range acks[:2] {
+		ack.done(true)
+	}
+	f := s.files[newFileIDOf(t, path)]
+	if f.acked != 0 {
+		t.Errorf("expected acknowledged offset 0 after the stale acknowledgments, got %d", f.acked)
+	}
+	acks[2].done(true)
+	if f.acked != 4 {
+		t.Errorf("expected acknowledged offset 4, got %d", f.acked)
+	}
+	s.saveRegistry()
+	r, err := newShipper(path, "", s.registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := r.saved[f.id]; e.Offset != 4 {
+		t.Errorf("expected registry offset 4, got %d", e.Offset)
+	}
+}
+
+// newFileIDOf returns the identifier of the file at path.
+func newFileIDOf(t *testing.T, path string) fileID {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFileID(info)
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"io"
-	"net"
+	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,7 +17,7 @@ const timeOutDelay = 15 * time.Second
 const flushPeriod = 100 * time.Millisecond
 
 // readAll is a blocking read for all data to be received.
-func readAll(conn net.Conn, buf []byte) error {
+func readAll(conn io.Reader, buf []byte) error {
 	for len(buf) > 0 {
 		n, err := conn.Read(buf)
 		if err != nil {
@@ -91,3 +93,17 @@ func copyFile(dstFile, srcFile string) (int64, error) {
 	nBytes, err := io.Copy(destination, source)
 	return nBytes, err
 }
+
+// shutdownSignal returns a channel closed when SIGINT or SIGTERM is received.
+func shutdownSignal() <-chan struct{} {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		sig := <-sigchan
+		log.Println("received signal", sig)
+		signal.Stop(sigchan)
+		close(shutdown)
+	}()
+	return shutdown
+}